@@ -1,6 +1,7 @@
 package bmg
 
 import (
+	"context"
 	"encoding/binary"
 	"fmt"
 )
@@ -21,26 +22,40 @@ type DiscreteAbs struct {
 
 // DiscreteAbsData holds all of the known fields from the plate reader response
 type DiscreteAbsData struct {
-	Total        int         `json:"total"`        // total number of values the run will produce
-	Complete     int         `json:"complete"`     // number of completed measurements
-	Wavelengths  int         `json:"wavelengths"`  // number of multichromats used per well (currently only supporting uniform)
-	Wells        int         `json:"wells"`        // number of wells measured
-	Temp         float32     `json:"temp"`         // the temperature of the incubator if enabled
-	Ovf          uint32      `json:"ovf"`          // overflow value
-	Transmission [][]float32 `json:"transmission"` // % transmission values, [well][wavelength] wells are row major order
+	Total        int         `json:"total"`                // total number of values the run will produce
+	Complete     int         `json:"complete"`             // number of completed measurements
+	Wavelengths  int         `json:"wavelengths"`          // number of multichromats used per well (currently only supporting uniform)
+	Wells        int         `json:"wells"`                // number of wells measured
+	Temp         float32     `json:"temp"`                 // the temperature of the incubator if enabled
+	Ovf          uint32      `json:"ovf"`                  // overflow value
+	Transmission [][]float32 `json:"transmission"`         // % transmission values, [well][wavelength] wells are row major order
+	Instrument   *Identity   `json:"instrument,omitempty"` // the instrument measuring, if identified
 }
 
-// RunAbsDiscrete runs DiscreteAbs, blocking
-func (c *Clario) RunAbsDiscrete(rc RunCfg, abs DiscreteAbs) (DiscreteAbsData, error) {
+// RunAbsDiscrete runs DiscreteAbs, blocking until the data is read or ctx is done
+//
+// unlike fluorescence, a run stopped by Abort returns no data with ErrAborted. The
+// transmission is computed against the chromat and reference channel reads taken at
+// the end of the run, so the raw reads made before the abort can't be converted.
+func (c *Clario) RunAbsDiscrete(ctx context.Context, rc RunCfg, abs DiscreteAbs) (DiscreteAbsData, error) {
 	cmd, err := absDiscreteBytes(rc, abs)
 	if err != nil {
 		return DiscreteAbsData{}, err
 	}
-	c.setup()
-	c.waitForReady()
-	c.write(cmd)
-	c.waitForReady()
-	resp, err := c.write(getData)
+	c.checkModule(ModuleAbsorbance)
+	end, err := c.begin("absorbance run")
+	if err != nil {
+		return DiscreteAbsData{}, err
+	}
+	defer end()
+
+	if err := c.prepare(ctx); err != nil {
+		return DiscreteAbsData{}, err
+	}
+	if err := c.measure(ctx, cmd); err != nil {
+		return DiscreteAbsData{}, err
+	}
+	resp, err := c.readData(ctx)
 	if err != nil {
 		return DiscreteAbsData{}, err
 	}
@@ -48,6 +63,7 @@ func (c *Clario) RunAbsDiscrete(rc RunCfg, abs DiscreteAbs) (DiscreteAbsData, er
 	if err != nil {
 		return DiscreteAbsData{}, err
 	}
+	r.Instrument = c.identity()
 	return r, nil
 
 }
@@ -145,6 +161,15 @@ func unmarshalAbsData(resp []byte) (DiscreteAbsData, error) {
 	d.Temp = float32(binary.BigEndian.Uint16(resp[23:25]) / 10)
 	// unknown 25-31
 
+	// the counts come from the instrument, check them before allocating. The raw reads
+	// are followed by the well, chromat (hi and lo) and reference channel references.
+	if d.Wells > maxWells || d.Wavelengths > maxWavelengths {
+		return DiscreteAbsData{}, fmt.Errorf("malformed data response, implausible %d wells at %d wavelengths", d.Wells, d.Wavelengths)
+	}
+	if n := d.Wells*d.Wavelengths + d.Wells + 2*d.Wavelengths + 2; 36+n*4 > len(resp) {
+		return DiscreteAbsData{}, fmt.Errorf("expected more data, %d values in %d bytes", n, len(resp))
+	}
+
 	// raw well reads
 	vals := make([]float32, d.Wells*d.Wavelengths)
 	var i, j = 36, 0
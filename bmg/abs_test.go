@@ -84,3 +84,22 @@ func TestUnmarshalAbsData(t *testing.T) {
 func fcmp(a, b float64, p float64) bool {
 	return !(math.Abs(a-b) > p)
 }
+
+func FuzzUnmarshalAbsData(f *testing.F) {
+	f.Add(absUnmarshalData)
+
+	f.Fuzz(func(t *testing.T, resp []byte) {
+		d, err := unmarshalAbsData(resp)
+		if err != nil {
+			return
+		}
+		if len(d.Transmission) != d.Wells {
+			t.Fatalf("%d wells decoded of %d", len(d.Transmission), d.Wells)
+		}
+		for _, w := range d.Transmission {
+			if len(w) != d.Wavelengths {
+				t.Fatalf("%d wavelengths decoded of %d", len(w), d.Wavelengths)
+			}
+		}
+	})
+}
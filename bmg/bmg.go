@@ -2,18 +2,52 @@
 package bmg
 
 import (
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"io"
+	"log/slog"
 	"slices"
+	"sync"
 	"time"
 )
 
 // |STX|Size(uint16)|NP|	Data	|Checksum(TCP)|CR|
 
+// Clario is a connection to a CLARIOstar plate reader over a Transport
+//
+// Clario is safe for concurrent use. Each command/reply exchange is serialized, so a
+// status query from another goroutine (e.g. GetStatus) is interleaved between the
+// polls of a run in progress rather than corrupting it. Operations that move the
+// instrument are mutually exclusive: while a run (RunFl, RunAbsDiscrete) or tray
+// motion (OpenTray, CloseTray) is in progress, starting another one fails with
+// ErrOperationInProgress.
 type Clario struct {
-	f io.ReadWriteCloser
+	f  Transport
+	fr *frameReader
+
+	cmdTimeout time.Duration // reply timeout of a single command
+	runTimeout time.Duration // limit on a measurement, 0 for none
+	stopRun    bool          // send stop when a measurement is cancelled, see StopOnCancel
+	checkReady bool          // refuse runs on the status flags, see CheckReady
+	experiment bool          // allow runs with unconfirmed encodings, see Experimental
+	poll       time.Duration // status poll interval while waiting on the instrument
+	log        *slog.Logger
+
+	exch    chan struct{} // held for the duration of a command/reply exchange
+	opMu    sync.Mutex
+	op      string // name of the run or tray motion in progress
+	aborted bool   // Abort was called during the run in progress
+
+	mu      sync.Mutex
+	pending chan reply      // hands the next frame to the outstanding command
+	late    bool            // a command gave up on its reply, the next frame is likely it
+	ateLate bool            // a frame was discarded as late while a command was pending
+	stray   chan StrayFrame // frames nobody was waiting for
+	rerr    error           // why the reader goroutine exited
+	rec     *Recorder       // tees frames to a recording
+	id      *Identity       // set by Identify
+	flags   []FlagID        // flags in the last status seen, for logging transitions
 }
 
 // Flags present in plate reader status message
@@ -62,6 +96,11 @@ var statusFlags = []Flag{
 	{FlagFilterCover, 1 << 6, 4},
 }
 
+// Flags returns the known status flag loci
+func Flags() []Flag {
+	return slices.Clone(statusFlags)
+}
+
 // apply flag masks and return slice of raised flags
 func parseStateFlags(state [5]byte) []FlagID {
 	var flags []FlagID
@@ -77,10 +116,14 @@ func parseStateFlags(state [5]byte) []FlagID {
 
 var initClario = []byte{0x01, 0x00, 0x00, 0x10, 0x02, 0x00}
 var cmdStatus = []byte{0x80, 0x00}
-var open = []byte{0x03, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00}
-var close = []byte{0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+var cmdOpen = []byte{0x03, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00}
+var cmdClose = []byte{0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
 var getData = []byte{0x05, 0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
 
+// stop appears to halt the current measurement/shaking, not yet confirmed on a capture
+// data measured before stopping seems to remain readable
+var stop = []byte{0x0b, 0x00}
+
 // Frames data according to the BMG serial protocol
 // STX | uint16 (size) | NP | data | uint16 (CS) | CR
 func frame(cmd []byte) []byte {
@@ -102,69 +145,173 @@ func frame(cmd []byte) []byte {
 }
 
 // write frames and writes the cmd to the plate reader and returns the unframed response
-func (c *Clario) write(cmd []byte) ([]byte, error) {
+//
+// the response is handed over by the reader goroutine, if none arrives within
+// the command timeout ErrTimeout is returned and the reply is treated as late when it shows up
+func (c *Clario) write(ctx context.Context, cmd []byte) ([]byte, error) {
+	if err := c.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer c.unlock()
+	return c.exchange(ctx, cmd)
+}
+
+// lock waits for exclusive use of the line or until ctx is done
+func (c *Clario) lock(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	select {
+	case c.exch <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// unlock releases the line
+func (c *Clario) unlock() {
+	<-c.exch
+}
+
+// exchange writes cmd and waits for its reply, the caller must hold the line
+func (c *Clario) exchange(ctx context.Context, cmd []byte) ([]byte, error) {
+	ch, err := c.expect()
+	if err != nil {
+		return nil, err
+	}
 
+	// don't let a stalled stream block past the reply timeout
+	if d, ok := c.f.(interface{ SetWriteDeadline(time.Time) error }); ok {
+		d.SetWriteDeadline(time.Now().Add(c.cmdTimeout))
+	}
 	buf := frame(cmd)
-	_, err := c.f.Write(buf)
+	// recorded ahead of the write so the reply can't be recorded first
+	c.recorder().record(Tx, buf)
+	c.log.Debug("tx", "cmd", cmdName(cmd), "len", len(buf), "data", HexBytes(cmd))
+	_, err = c.f.Write(buf)
 	if err != nil {
+		c.log.Warn("write failed", "cmd", cmdName(cmd), "err", err)
+		c.abandon(ch, false)
 		return nil, err
 	}
-	return c.readFrame()
+
+	t := time.NewTimer(c.cmdTimeout)
+	defer t.Stop()
+	select {
+	case r := <-ch:
+		c.received(cmd, r)
+		return r.data, r.err
+	case <-t.C:
+		c.log.Warn("no reply", "cmd", cmdName(cmd), "timeout", c.cmdTimeout)
+		err = ErrTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	// the reply may have been handed over while giving up
+	if r, ok := c.abandon(ch, true); ok {
+		c.received(cmd, r)
+		return r.data, r.err
+	}
+	return nil, err
 }
 
-// Open connection to Clariostar
+// received logs the reply to cmd, and any change in the flags if it is a status
+func (c *Clario) received(cmd []byte, r reply) {
+	if r.err != nil {
+		c.log.Warn("reply failed", "cmd", cmdName(cmd), "err", r.err)
+		return
+	}
+	c.log.Debug("rx", "cmd", cmdName(cmd), "len", len(r.data)+7, "data", HexBytes(r.data))
+	if len(r.data) != 17 {
+		return
+	}
+
+	flags := parseStateFlags([5]byte(r.data[0:5]))
+	c.mu.Lock()
+	last := c.flags
+	c.flags = flags
+	c.mu.Unlock()
+	if slices.Equal(flags, last) {
+		return
+	}
+	var raised, cleared []FlagID
+	for _, f := range flags {
+		if !slices.Contains(last, f) {
+			raised = append(raised, f)
+		}
+	}
+	for _, f := range last {
+		if !slices.Contains(flags, f) {
+			cleared = append(cleared, f)
+		}
+	}
+	c.log.Info("status", "raised", raised, "cleared", cleared)
+}
+
+// Open connection to Clariostar over its serial port
 //
-// If using the provided udev rules the tty will be /dev/clario on linux.
-func Open(tty string) (*Clario, error) {
+// If using the provided udev rules the tty will be /dev/clario on linux. Every Option
+// applies, see OpenSerial and New.
+func Open(tty string, opts ...Option) (*Clario, error) {
 	// linux implementation is /dev/clario
-	f, err := openPort(tty)
+	f, err := OpenSerial(tty, opts...)
 	if err != nil {
 		return nil, err
 	}
 
-	c := &Clario{f}
+	return New(f, opts...), nil
+}
 
-	return c, nil
+// Dial connects to a plate reader exposed over TCP by a Bridge on another host
+//
+// the connection is refused (closed on connect) while another client is using the bridge.
+func Dial(addr string, opts ...Option) (*Clario, error) {
+	t, err := DialTCP(addr, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return New(t, opts...), nil
+}
+
+// New returns a Clario speaking the plate reader protocol over t
+//
+// a single goroutine reads frames from t until it is closed. The timeout, poll and
+// logger options apply.
+func New(t Transport, opts ...Option) *Clario {
+	o := collect(opts)
+	c := &Clario{
+		f:          t,
+		fr:         newFrameReader(t),
+		cmdTimeout: o.cmdTimeout,
+		runTimeout: o.runTimeout,
+		stopRun:    o.stopRun,
+		checkReady: o.checkReady,
+		experiment: o.experiment,
+		poll:       o.poll,
+		log:        o.log,
+		exch:       make(chan struct{}, 1),
+		stray:      make(chan StrayFrame, strayBuffer),
+	}
+	go c.readLoop()
+	return c
 }
 
-// Close closes the tty fd
+// Close closes the underlying transport, stopping the reader goroutine
 func (c *Clario) Close() {
 	c.f.Close()
 }
 
-// PollState infinitely polls status and prints bit fields and identified flags
-// used for perturbing system state to identify single bit flags
-func (c *Clario) PollState() {
+// waitForReady blocks until the busy flag is not raised or ctx is done
+func (c *Clario) waitForReady(ctx context.Context) error {
 	var last []byte
 	for {
-		time.Sleep(time.Millisecond * 100)
-		resp, err := c.write(cmdStatus)
-		if err != nil {
-			fmt.Println(err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(c.poll):
 		}
-		if len(resp) != 17 {
-			fmt.Printf("malformed status response. got %d bytes", len(resp))
-		} else {
-			if !slices.Equal(resp, last) {
-				for i := 0; i < 6; i++ {
-					fmt.Printf("%d: %08b ", i, resp[i])
-				}
-				fmt.Println()
-				flags := parseStateFlags(([5]byte)(resp[0:5]))
-				fmt.Println(flags)
-			}
-			last = resp
-
-		}
-	}
-}
-
-// waitForReady blocks until the busy flag is not raised
-func (c *Clario) waitForReady() error {
-	var last []byte
-	for {
-		time.Sleep(time.Millisecond * 100)
-		resp, err := c.write(cmdStatus)
+		resp, err := c.write(ctx, cmdStatus)
 		if err != nil {
 			return err
 		}
@@ -183,48 +330,137 @@ func (c *Clario) waitForReady() error {
 	}
 }
 
-// Status of Clariostar, currently only implements the single bit flags
+// Status of Clariostar
+//
+// Bytes 0-4 hold the single bit flags. The layout of bytes 5-16 is a guess modelled on
+// the header of the data response, no status captured during a run has been checked
+// against it:
+//
+//	0     schema
+//	1-4   flag bit field
+//	5     error code, 0 when no error is reported
+//	6     schema of the active (or last) measurement, as in the data response
+//	7-8   number of values the run will produce
+//	9-10  number of values measured so far
+//	11-12 bottom incubator temperature * 10, 0 when off
+//	13-14 top incubator temperature * 10, 0 when off
+//	15-16 unknown
 //
-// TODO: status has many bytes set durring a run that are yet to be RE'd
-// seems that spectral captures use a different schema following the bitfield
+// TODO: seems that spectral captures use a different schema following the bitfield
 type Status struct {
-	Flags []FlagID `json:"flags"`
+	Flags    []FlagID   `json:"flags"`
+	Schema   byte       `json:"schema"`   // status schema byte
+	Error    byte       `json:"error"`    // instrument error code, 0 for none
+	Modality byte       `json:"modality"` // schema of the active measurement (e.g. 0x21 fl, 0x29 abs)
+	Total    int        `json:"total"`    // values the run will produce
+	Complete int        `json:"complete"` // values measured so far
+	Temps    [2]float32 `json:"temps"`    // bottom and top incubator temperatures (C), 0 when off
+	Raw      HexBytes   `json:"raw"`      // the complete status response
 }
 
-// GetStatus requests an updated status from the plate reader and returns the result
-func (c *Clario) GetStatus() (Status, error) {
-	s := Status{}
+// Progress returns the fraction of the run completed, 0 when no run is reported
+func (s Status) Progress() float64 {
+	if s.Total == 0 {
+		return 0
+	}
+	return float64(s.Complete) / float64(s.Total)
+}
 
-	resp, err := c.write(cmdStatus)
+// GetStatus requests an updated status from the plate reader and returns the result
+func (c *Clario) GetStatus(ctx context.Context) (Status, error) {
+	resp, err := c.write(ctx, cmdStatus)
 	if err != nil {
-		return s, nil
+		return Status{}, err
 	}
+	return parseStatus(resp)
+}
+
+// parseStatus decodes a status response
+func parseStatus(resp []byte) (Status, error) {
 	if len(resp) != 17 {
-		return s, fmt.Errorf("malformed status response. got %d bytes", len(resp))
+		return Status{}, fmt.Errorf("malformed status response. got %d bytes", len(resp))
 	}
 
-	s.Flags = parseStateFlags([5]byte(resp[0:5]))
+	s := Status{
+		Flags:    parseStateFlags([5]byte(resp[0:5])),
+		Schema:   resp[0],
+		Error:    resp[5],
+		Modality: resp[6],
+		Total:    int(binary.BigEndian.Uint16(resp[7:9])),
+		Complete: int(binary.BigEndian.Uint16(resp[9:11])),
+		Raw:      slices.Clone(resp),
+	}
+	s.Temps[0] = float32(binary.BigEndian.Uint16(resp[11:13])) / 10
+	s.Temps[1] = float32(binary.BigEndian.Uint16(resp[13:15])) / 10
 	return s, nil
 }
 
 // Setup runs plate reader initialization
 //
 // moves the plate underneath optical stage and probes for presence detection
-func (c *Clario) setup() error {
-	_, err := c.write(initClario)
+func (c *Clario) setup(ctx context.Context) error {
+	return c.command(ctx, initClario)
+}
+
+// command writes a command answered with a status and returns any error reported
+func (c *Clario) command(ctx context.Context, cmd []byte) error {
+	resp, err := c.write(ctx, cmd)
 	if err != nil {
 		return err
 	}
-	return nil
+	return c.rejected(cmd, resp)
 }
 
-// Opentray opens the plate tray, blocking
-func (c *Clario) OpenTray() error {
-	_, err := c.write(open)
+// rejected returns the error reported in a status shaped reply to cmd, known codes
+// fail only with the Experimental option (see errorCodes) and are logged otherwise
+func (c *Clario) rejected(cmd, resp []byte) error {
+	var ie *InstrumentError
+	if err := replyError(cmd, resp); !errors.As(err, &ie) {
+		return nil
+	}
+	if !c.experiment || ie.Err == ErrRejected {
+		c.log.Warn("status reports error code, not acted on", "cmd", ie.Cmd, "code", ie.Code)
+		return nil
+	}
+	c.log.Warn("command rejected", "cmd", ie.Cmd, "err", ie)
+	return ie
+}
+
+// prepare initializes the plate reader ahead of a run, with CheckReady set it also
+// checks the status flags allow a measurement
+//
+// otherwise a lid left open or a missing plate is left to the instrument to reject.
+func (c *Clario) prepare(ctx context.Context) error {
+	c.log.Info("initializing")
+	if err := c.setup(ctx); err != nil {
+		return err
+	}
+	if err := c.waitForReady(ctx); err != nil {
+		return err
+	}
+	if !c.checkReady {
+		return nil
+	}
+	s, err := c.GetStatus(ctx)
+	if err != nil {
+		return err
+	}
+	return readyError(s)
+}
+
+// Opentray opens the plate tray, blocking until the tray has stopped or ctx is done
+func (c *Clario) OpenTray(ctx context.Context) error {
+	end, err := c.begin("open tray")
 	if err != nil {
 		return err
 	}
-	err = c.waitForReady()
+	defer end()
+
+	err = c.command(ctx, cmdOpen)
+	if err != nil {
+		return err
+	}
+	err = c.waitForReady(ctx)
 	if err != nil {
 		return err
 	}
@@ -232,103 +468,169 @@ func (c *Clario) OpenTray() error {
 
 }
 
-// CloseTray closes the plate tray, blocking
-func (c *Clario) CloseTray() error {
-	_, err := c.write(close)
+// CloseTray closes the plate tray, blocking until the tray has stopped or ctx is done
+func (c *Clario) CloseTray(ctx context.Context) error {
+	end, err := c.begin("close tray")
 	if err != nil {
 		return err
 	}
-	err = c.waitForReady()
+	defer end()
+
+	err = c.command(ctx, cmdClose)
+	if err != nil {
+		return err
+	}
+	err = c.waitForReady(ctx)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-// Checksum (sum of header + data bytes) is incorrect
-var ErrChecksumInvalid = errors.New("invalid checksum")
-
-// Header doesn't begin with 0x02 (STX) or end with 0x0d (carriage return)
-var ErrFraming = errors.New("framing errror")
-
-// timeout in reading
-var ErrTimeout = errors.New("read timout")
-
-// readFrame reads a data frame, timeout if duration has passed with os.ErrDeadlineExceeded
-// resultant bytes have the header, subsequent carriage return, checksum, and termination
-// byte stripped from the returned slice
-//
-// TODO:
-// Seems like the messages sent from the plate reader all include ~5 bytes of bit flags
-// following the first byte after the carraige return (schema byte?)
-func (c *Clario) readFrame() ([]byte, error) {
-
-	// Read the "header" 0x02 {len (uint16)} 0x0c
-	header := make([]byte, 4)
+// begin claims the instrument for the named run or tray motion, the returned func
+// releases it
+func (c *Clario) begin(name string) (func(), error) {
+	c.opMu.Lock()
+	defer c.opMu.Unlock()
+	if c.op != "" {
+		return nil, fmt.Errorf("%w: %s", ErrOperationInProgress, c.op)
+	}
+	c.op = name
+	c.aborted = false
+	c.log.Info("started", "op", name)
+	start := time.Now()
+	return func() {
+		c.opMu.Lock()
+		c.op = ""
+		c.opMu.Unlock()
+		c.log.Info("finished", "op", name, "took", time.Since(start))
+	}, nil
+}
 
-	ch := make(chan error)
-	go func() {
-		_, err := io.ReadFull(c.f, header)
-		if err != nil {
-			ch <- fmt.Errorf("read error: %w", err)
-		}
-		ch <- nil
-	}()
+// measure sends a run command and blocks until the measurement completes, if ctx is
+// done before the run finishes the instrument is told to stop when StopOnCancel is set.
+// ErrAborted is returned if the run was stopped by Abort.
+func (c *Clario) measure(ctx context.Context, cmd []byte) error {
+	c.opMu.Lock()
+	aborted := c.aborted
+	c.opMu.Unlock()
+	if aborted {
+		return ErrAborted
+	}
 
-	select {
-	case err := <-ch:
-		if err != nil {
-			return nil, err
-		}
-	case <-time.After(time.Second * 10):
-		return nil, ErrTimeout
+	if c.runTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.runTimeout)
+		defer cancel()
+	}
+	c.log.Info("measuring")
+	err := c.command(ctx, cmd)
+	if err == nil {
+		err = c.waitForReady(ctx)
+	}
+	if err != nil && ctx.Err() != nil {
+		// the run command may have been written even if its reply never came
+		return c.interrupt(ctx, err)
 	}
-	// validate beginning of frame
-	if header[0] != 0x02 {
-		return nil, errors.Join(ErrFraming, fmt.Errorf("header doesn't beging with 0x02"))
+	if err != nil {
+		return err
 	}
 
-	// Read the remainder of the message
-	data := make([]byte, binary.BigEndian.Uint16(header[1:3])-4)
-	ch = make(chan error)
+	c.opMu.Lock()
+	defer c.opMu.Unlock()
+	if c.aborted {
+		return ErrAborted
+	}
+	return nil
+}
 
-	go func() {
-		_, err := io.ReadFull(c.f, data)
-		if err != nil {
-			ch <- err
-		}
-		ch <- nil
-	}()
+// interrupt handles a measurement cancelled by ctx, telling the instrument to stop and
+// waiting for it to come to rest if StopOnCancel is set
+func (c *Clario) interrupt(ctx context.Context, err error) error {
+	if !c.stopRun {
+		c.log.Warn("run cancelled, instrument may still be measuring", "err", err)
+		return err
+	}
+	c.log.Warn("stopping run", "err", err)
+	sctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), stopTimeout)
+	defer cancel()
+	if serr := c.command(sctx, stop); serr != nil {
+		return errors.Join(err, fmt.Errorf("could not stop run: %w", serr))
+	}
+	if serr := c.waitForReady(sctx); serr != nil {
+		return errors.Join(err, fmt.Errorf("instrument busy after stop: %w", serr))
+	}
+	return err
+}
 
-	select {
-	case err := <-ch:
-		if err != nil {
-			return nil, err
-		}
-	case <-time.After(time.Second * 10):
-		return nil, ErrTimeout
+// Abort halts the measurement or shaking in progress and blocks until the instrument
+// is no longer busy. It returns whether partial data can be retrieved, in which case
+// an interrupted fluorescence run (RunFl, RunFlScan, RunTRFRET) returns it alongside
+// ErrAborted. Absorbance runs return none, see RunAbsDiscrete.
+//
+// Abort may be called while a run is in progress in another goroutine, the run then
+// fails with ErrAborted.
+//
+// Experimental: the stop opcode has not been captured, the instrument may ignore it and
+// finish the run. Abort fails with ErrExperimental without the Experimental option.
+func (c *Clario) Abort(ctx context.Context) (bool, error) {
+	if err := c.allow("abort"); err != nil {
+		return false, err
 	}
+	c.log.Warn("aborting")
+	c.opMu.Lock()
+	c.aborted = true
+	c.opMu.Unlock()
 
-	// calculate checksum
-	var sum uint16
-	for i := range header {
-		sum += uint16(header[i])
+	resp, err := c.write(ctx, stop)
+	if err != nil {
+		return false, err
 	}
-	for i := 0; i < len(data)-3; i++ {
-		sum += uint16(data[i])
+	if err := c.rejected(stop, resp); err != nil {
+		return false, err
 	}
-	cs := []byte{byte(sum >> 8), byte(sum & 0xff)}
-
-	// check that checksum is correct
-	if !slices.Equal(cs, data[len(data)-3:len(data)-1]) {
-		return nil, ErrChecksumInvalid
+	// the interrupted run may read the data as soon as the instrument is ready, so the
+	// flag is checked in the reply to stop as well
+	partial := false
+	if s, err := parseStatus(resp); err == nil {
+		partial = slices.Contains(s.Flags, FlagUnreadData)
 	}
 
-	// validate end of frame
-	if data[len(data)-1] != 0x0d {
-		return nil, errors.Join(ErrFraming, fmt.Errorf("message not terminated with 0x0d"))
+	if err := c.waitForReady(ctx); err != nil {
+		return false, err
+	}
+	s, err := c.GetStatus(ctx)
+	if err != nil {
+		return false, err
 	}
+	return partial || slices.Contains(s.Flags, FlagUnreadData), nil
+}
 
-	return data[:len(data)-3], nil
+// Checksum (sum of header + data bytes) is incorrect
+var ErrChecksumInvalid = errors.New("invalid checksum")
 
-}
+// Header doesn't begin with 0x02 (STX) or end with 0x0d (carriage return)
+//
+// the frame reader resynchronizes on such input, see FrameStats
+var ErrFraming = errors.New("framing errror")
+
+// timeout in reading
+var ErrTimeout = errors.New("read timout")
+
+// the transport was closed or failed, no further frames can be read
+var ErrClosed = errors.New("connection closed")
+
+// a run or tray motion was requested while another is in progress
+var ErrOperationInProgress = errors.New("operation in progress")
+
+// the run was stopped by Abort
+var ErrAborted = errors.New("run aborted")
+
+// default time to wait for the reply to a command, see CmdTimeout
+const cmdTimeout = time.Second * 10
+
+// time allowed for a run to come to rest after being stopped on cancel
+const stopTimeout = time.Second * 30
+
+// default status poll interval, see PollInterval
+const pollInterval = time.Millisecond * 100
@@ -1,9 +1,12 @@
 package bmg
 
 import (
+	"context"
 	"errors"
+	"io"
 	"net"
 	"slices"
+	"strings"
 	"testing"
 	"time"
 )
@@ -11,7 +14,7 @@ import (
 func TestInit(t *testing.T) {
 	cl, te := net.Pipe()
 
-	c := &Clario{cl}
+	c := New(cl)
 
 	fail := make(chan bool)
 	go func() {
@@ -30,7 +33,7 @@ func TestInit(t *testing.T) {
 		fail <- false
 	}()
 
-	c.setup()
+	c.setup(context.Background())
 
 	select {
 	case f := <-fail:
@@ -45,10 +48,237 @@ func TestInit(t *testing.T) {
 }
 
 func TestReadTimeout(t *testing.T) {
-	cl, _ := net.Pipe()
-	c := &Clario{cl}
-	_, err := c.readFrame()
+	cl, te := net.Pipe()
+	go io.Copy(io.Discard, te)
+	c := New(cl)
+	_, err := c.write(context.Background(), cmdStatus)
 	if !errors.Is(err, ErrTimeout) {
 		t.Fail()
 	}
 }
+
+func TestReadCancel(t *testing.T) {
+	cl, te := net.Pipe()
+	go io.Copy(io.Discard, te)
+	c := New(cl)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err := c.write(ctx, cmdStatus)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fail()
+	}
+}
+
+// a run cancelled before its command was answered is still stopped, and measure waits
+// for the instrument to come to rest
+func TestMeasureCancelStops(t *testing.T) {
+	cl, te := net.Pipe()
+	c := New(cl, StopOnCancel(), PollInterval(5*time.Millisecond))
+	defer c.Close()
+
+	idle := []byte{0x01, 0x05, 0x00, 0x27, 0x00, 0x00, 0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xc0, 0x00}
+	stopped := make(chan bool, 1)
+	go func() {
+		fr := newFrameReader(te)
+		// the run command is answered after measure gave up on it
+		if _, err := fr.readFrame(); err != nil {
+			return
+		}
+		time.Sleep(150 * time.Millisecond)
+		te.Write(frame(idle))
+		cmd, err := fr.readFrame()
+		if err != nil {
+			return
+		}
+		stopped <- slices.Equal(cmd, stop)
+		for {
+			te.Write(frame(idle))
+			if _, err := fr.readFrame(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err := c.measure(ctx, []byte{0x04})
+	if !errors.Is(err, context.DeadlineExceeded) || strings.Contains(err.Error(), "stop") {
+		t.Fatalf("expected deadline exceeded alone, got %v", err)
+	}
+	select {
+	case ok := <-stopped:
+		if !ok {
+			t.Fatal("stop not sent after cancel")
+		}
+	default:
+		t.Fatal("measure returned before stopping the run")
+	}
+}
+
+// a run on a loaded instrument isn't refused on its (partly understood) status flags
+func TestPrepareCaptured(t *testing.T) {
+	status := statusResp[4 : len(statusResp)-3]
+	idle := slices.Clone(status)
+	idle[1] &^= 1 << 5
+
+	for _, check := range []bool{false, true} {
+		cl, te := net.Pipe()
+		opts := []Option{PollInterval(time.Millisecond)}
+		if check {
+			opts = append(opts, CheckReady())
+		}
+		c := New(cl, opts...)
+		go func() {
+			fr := newFrameReader(te)
+			// initialization is answered with the captured status, busy until it settles
+			for i := 0; ; i++ {
+				if _, err := fr.readFrame(); err != nil {
+					return
+				}
+				if i < 2 {
+					te.Write(frame(status))
+				} else {
+					te.Write(frame(idle))
+				}
+			}
+		}()
+
+		err := c.prepare(context.Background())
+		c.Close()
+		switch {
+		case !check && err != nil:
+			t.Fatalf("captured status refused: %v", err)
+		case check && !errors.Is(err, ErrTrayOpen):
+			t.Fatalf("expected the captured status to read as tray open, got %v", err)
+		}
+	}
+}
+
+// a reply arriving after its command gave up must not be taken as the next reply
+func TestLateReply(t *testing.T) {
+	cl, te := net.Pipe()
+	c := New(cl)
+	defer c.Close()
+
+	cmds := make(chan []byte)
+	go func() {
+		for {
+			buf := make([]byte, len(frame(cmdStatus)))
+			if _, err := io.ReadFull(te, buf); err != nil {
+				return
+			}
+			cmds <- buf
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	gaveUp := make(chan struct{})
+	go func() {
+		<-cmds
+		<-gaveUp
+		te.Write(frame([]byte{0x01}))
+		<-cmds
+		te.Write(frame([]byte{0x02}))
+	}()
+
+	if _, err := c.write(ctx, cmdStatus); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+	close(gaveUp)
+	// wait for the late reply so it can't race the next command
+	select {
+	case s := <-c.Stray():
+		if !s.Late || !slices.Equal(s.Data, []byte{0x01}) {
+			t.Fatalf("unexpected stray frame %+v", s)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("late reply not surfaced")
+	}
+
+	resp, err := c.write(context.Background(), cmdStatus)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(resp, []byte{0x02}) {
+		t.Fatalf("got reply %v", resp)
+	}
+}
+
+func TestParseStatus(t *testing.T) {
+	// hand made to the guessed layout, not a capture
+	resp := []byte{0x01, 0x35, 0x00, 0x2e, 0x00, 0x00, 0x21, 0x00, 0x60, 0x00, 0x18, 0x01, 0x6d, 0x00, 0x00, 0xc0, 0x00}
+	s, err := parseStatus(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Modality != 0x21 || s.Total != 96 || s.Complete != 24 || s.Progress() != 0.25 {
+		t.Fatalf("unexpected progress %+v", s)
+	}
+	if !fcmp(float64(s.Temps[0]), 36.5, 0.001) || s.Temps[1] != 0 {
+		t.Fatalf("unexpected temps %v", s.Temps)
+	}
+	if !slices.Contains(s.Flags, FlagRunning) || !slices.Contains(s.Flags, FlagActive) || !slices.Equal(s.Raw, resp) {
+		t.Fatalf("unexpected flags %v", s.Flags)
+	}
+
+	if _, err := parseStatus(resp[:16]); err == nil {
+		t.Fatal("expected error for short status")
+	}
+}
+
+// the guessed error codes fail commands only with the Experimental option
+func TestInstrumentError(t *testing.T) {
+	for _, experimental := range []bool{true, false} {
+		cl, te := net.Pipe()
+		opts := []Option{PollInterval(time.Millisecond)}
+		if experimental {
+			opts = append(opts, Experimental())
+		}
+		c := New(cl, opts...)
+
+		go func() {
+			fr := newFrameReader(te)
+			if _, err := fr.readFrame(); err != nil {
+				return
+			}
+			te.Write(frame([]byte{0x01, 0x01, 0x00, 0x20, 0x00, 0x03, 0x03, 0x00, 0x00, 0x00, 0x00,
+				0x00, 0x00, 0x00, 0x00, 0xc0, 0x00}))
+			for {
+				if _, err := fr.readFrame(); err != nil {
+					return
+				}
+				te.Write(frame([]byte{0x01, 0x01, 0x00, 0x20, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+					0x00, 0x00, 0x00, 0x00, 0xc0, 0x00}))
+			}
+		}()
+
+		err := c.OpenTray(context.Background())
+		c.Close()
+		var ie *InstrumentError
+		switch {
+		case experimental && (!errors.Is(err, ErrLidOpen) || !errors.Is(err, ErrRejected) || !errors.As(err, &ie) || ie.Code != 0x03 || ie.Cmd != "tray"):
+			t.Fatalf("unexpected error %v", err)
+		case !experimental && err != nil:
+			t.Fatalf("guessed error code acted on: %v", err)
+		}
+	}
+}
+
+func FuzzParseStateFlags(f *testing.F) {
+	f.Add(statusResp[4:21])
+	f.Add([]byte{0x01, 0x35, 0x00, 0x2e, 0x00})
+
+	f.Fuzz(func(t *testing.T, resp []byte) {
+		if len(resp) >= 5 {
+			flags := parseStateFlags([5]byte(resp[:5]))
+			if len(flags) > len(statusFlags) {
+				t.Fatalf("%d flags raised of %d", len(flags), len(statusFlags))
+			}
+		}
+		s, err := parseStatus(resp)
+		if err == nil && len(s.Raw) != 17 {
+			t.Fatalf("status parsed from %d bytes", len(s.Raw))
+		}
+	})
+}
@@ -0,0 +1,163 @@
+package bmg
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+// keepalive period for bridge connections, a client vanishing without closing its
+// connection releases the instrument once the probes fail
+const bridgeKeepAlive = time.Second * 15
+
+// returned by Bridge.Serve after Close
+var ErrBridgeClosed = errors.New("bridge closed")
+
+// Bridge exposes a Transport, usually the serial port, over TCP so the plate reader
+// can be driven from another host with Dial
+//
+// only one client is served at a time, connections made while the instrument is in use
+// are closed straight away. Bytes from the instrument with no client connected are
+// dropped, the frame reader of the next client resynchronizes on any partial frame.
+type Bridge struct {
+	t   Transport
+	log *slog.Logger
+
+	mu     sync.Mutex
+	client net.Conn
+	err    error // why the transport failed
+}
+
+// NewBridge returns a Bridge to t, start it with Serve
+//
+// clients coming and going are reported to the Logger option.
+func NewBridge(t Transport, opts ...Option) *Bridge {
+	return &Bridge{t: t, log: collect(opts).log}
+}
+
+// Serve accepts clients on l until l is closed or the transport fails, in which case l
+// is closed and the transport error returned
+func (b *Bridge) Serve(l net.Listener) error {
+	go b.readLoop(l)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			if b.err != nil {
+				return b.err
+			}
+			return err
+		}
+
+		b.mu.Lock()
+		busy := b.client != nil
+		if !busy {
+			b.client = conn
+		}
+		b.mu.Unlock()
+		if busy {
+			b.log.Warn("refused client, instrument in use", "client", conn.RemoteAddr(), "holder", b.Client())
+			conn.Close()
+			continue
+		}
+		b.log.Info("client connected", "client", conn.RemoteAddr())
+
+		if tc, ok := conn.(*net.TCPConn); ok {
+			tc.SetKeepAlive(true)
+			tc.SetKeepAlivePeriod(bridgeKeepAlive)
+		}
+		go b.serveClient(conn)
+	}
+}
+
+// Client returns the address of the connected client, empty if there is none
+func (b *Bridge) Client() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.client == nil {
+		return ""
+	}
+	return b.client.RemoteAddr().String()
+}
+
+// serveClient writes the client's bytes to the transport until either fails
+func (b *Bridge) serveClient(conn net.Conn) {
+	buf := make([]byte, 1024)
+	for {
+		n, err := conn.Read(buf)
+		if n > 0 {
+			if _, werr := b.t.Write(buf[:n]); werr != nil {
+				break
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	b.drop(conn)
+}
+
+// drop disconnects conn, releasing the instrument for the next client
+func (b *Bridge) drop(conn net.Conn) {
+	conn.Close()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.client == conn {
+		b.client = nil
+		b.log.Info("client disconnected", "client", conn.RemoteAddr())
+	}
+}
+
+// readLoop forwards everything read from the transport to the connected client
+func (b *Bridge) readLoop(l net.Listener) {
+	buf := make([]byte, 1024)
+	for {
+		n, err := b.t.Read(buf)
+		if n > 0 {
+			b.mu.Lock()
+			conn := b.client
+			b.mu.Unlock()
+			if conn != nil {
+				// a stalled client is dropped rather than holding up the line
+				conn.SetWriteDeadline(time.Now().Add(cmdTimeout))
+				if _, err := conn.Write(buf[:n]); err != nil {
+					b.drop(conn)
+				}
+			}
+		}
+		if errors.Is(err, ErrReconnected) {
+			// the port was reopened under the client, an exchange in flight times out
+			// on its end and the line carries on
+			continue
+		}
+		if err != nil {
+			b.mu.Lock()
+			if b.err == nil {
+				b.err = fmt.Errorf("error reading transport: %w", err)
+			}
+			if b.client != nil {
+				b.client.Close()
+			}
+			b.mu.Unlock()
+			l.Close()
+			return
+		}
+	}
+}
+
+// Close disconnects the client and closes the transport, stopping Serve
+func (b *Bridge) Close() error {
+	b.mu.Lock()
+	if b.err == nil {
+		b.err = ErrBridgeClosed
+	}
+	if b.client != nil {
+		b.client.Close()
+	}
+	b.mu.Unlock()
+	return b.t.Close()
+}
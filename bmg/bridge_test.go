@@ -0,0 +1,70 @@
+package bmg
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBridge(t *testing.T) {
+	// the instrument end answers every command with a status
+	dev, te := net.Pipe()
+	go func() {
+		buf := make([]byte, len(frame(cmdStatus)))
+		for {
+			if _, err := io.ReadFull(te, buf); err != nil {
+				return
+			}
+			te.Write(statusResp)
+		}
+	}()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := NewBridge(dev)
+	served := make(chan error, 1)
+	go func() { served <- b.Serve(l) }()
+	ctx := context.Background()
+
+	c, err := Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GetStatus(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// refused while the first client is connected
+	c2, err := Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c2.GetStatus(ctx); !errors.Is(err, ErrClosed) {
+		t.Fatalf("second client not refused: %v", err)
+	}
+	c2.Close()
+
+	// released once the first client disconnects
+	c.Close()
+	for b.Client() != "" {
+		time.Sleep(time.Millisecond)
+	}
+	c3, err := Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c3.GetStatus(ctx); err != nil {
+		t.Fatal(err)
+	}
+	c3.Close()
+
+	b.Close()
+	if err := <-served; !errors.Is(err, ErrBridgeClosed) {
+		t.Fatalf("unexpected serve error %v", err)
+	}
+}
@@ -0,0 +1,53 @@
+package bmg
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// header length of the data response by schema, the values follow as uint32s and the
+// response ends with a single 0x00
+var dataHeader = map[byte]int{
+	0x21: 34, // fluorescence
+	0x29: 36, // absorbance
+}
+
+// largest plausible counts in a data response, the plate bit field selects at most 384
+// wells and a run measures at most 8 wavelengths (abs) or 5 chromats (fl) per well
+const (
+	maxWells       = 384
+	maxWavelengths = 8
+	maxFlChromats  = 5
+)
+
+// the data response held fewer values than the run produced
+//
+// large results (e.g. 384 wells at 8 wavelengths, spectral scans) may be split across
+// several blocks by the instrument, how further blocks are requested hasn't been seen
+// on the wire yet so they aren't requested on a guess.
+var ErrMultiBlock = errors.New("data spans several blocks, not supported yet")
+
+// readData retrieves the data of the last run, checking the first block holds the
+// Complete values in the header
+func (c *Clario) readData(ctx context.Context) ([]byte, error) {
+	resp, err := c.write(ctx, getData)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) < 11 {
+		return nil, fmt.Errorf("malformed data response, too short")
+	}
+	hdr, ok := dataHeader[resp[6]]
+	if !ok || len(resp) < hdr+1 {
+		// nothing known to check, left to the decoder to make sense of
+		return resp, nil
+	}
+
+	want := int(binary.BigEndian.Uint16(resp[9:11]))
+	if got := (len(resp) - hdr - 1) / 4; got < want {
+		return nil, fmt.Errorf("%w: %d of %d values in the first block", ErrMultiBlock, got, want)
+	}
+	return resp, nil
+}
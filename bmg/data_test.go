@@ -0,0 +1,58 @@
+package bmg
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+)
+
+// flBlock returns a fluorescence data response whose header reports complete values,
+// holding n of them
+func flBlock(complete, n int) []byte {
+	resp := make([]byte, dataHeader[0x21], dataHeader[0x21]+n*4+1)
+	resp[0] = 0x02
+	resp[6] = 0x21
+	binary.BigEndian.PutUint16(resp[7:9], uint16(complete))
+	binary.BigEndian.PutUint16(resp[9:11], uint16(complete))
+	for i := range n {
+		resp = binary.BigEndian.AppendUint32(resp, uint32(1000+i))
+	}
+	return append(resp, 0x00)
+}
+
+// a first block short of the values in its header isn't mistaken for the whole result
+func TestReadData(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		resp     []byte
+		multiple bool
+	}{
+		{"single block", flBlock(4, 4), false},
+		{"first of several", flBlock(4, 2), true},
+	} {
+		cl, te := net.Pipe()
+		c := New(cl)
+		go func() {
+			fr := newFrameReader(te)
+			if _, err := fr.readFrame(); err != nil {
+				return
+			}
+			te.Write(frame(tc.resp))
+		}()
+
+		d, err := c.readData(context.Background())
+		c.Close()
+		switch {
+		case tc.multiple && (!errors.Is(err, ErrMultiBlock) || d != nil):
+			t.Fatalf("%s: expected multi-block error and no data, got %v, % x", tc.name, err, d)
+		case tc.multiple && err.Error() != "data spans several blocks, not supported yet: 2 of 4 values in the first block":
+			t.Fatalf("%s: unexpected error %v", tc.name, err)
+		case !tc.multiple && err != nil:
+			t.Fatalf("%s: %v", tc.name, err)
+		case !tc.multiple && len(d) != len(tc.resp):
+			t.Fatalf("%s: got %d bytes, want %d", tc.name, len(d), len(tc.resp))
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package bmg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// Run is a run command decoded back into its configuration
+type Run struct {
+	Cfg     RunCfg         `json:"cfg"`
+	Fl      *FlCfg         `json:"fl,omitempty"`      // set for fluorescence runs
+	FlScan  *FlScan        `json:"fl_scan,omitempty"` // set for fluorescence spectral scans
+	Abs     *DiscreteAbs   `json:"abs,omitempty"`     // set for discrete absorbance runs
+	Unknown []UnknownField `json:"unknown,omitempty"` // bytes of unknown meaning that differ from what the encoder writes
+}
+
+// UnknownField is a span of a run command whose meaning hasn't been worked out, reported
+// by DecodeRun when it differs from the constant the encoders write
+type UnknownField struct {
+	Offset int      `json:"offset"` // offset into the unframed command
+	Got    HexBytes `json:"got"`
+	Want   HexBytes `json:"want"`
+}
+
+// DecodeRun decodes a run command, as built by RunFl, RunFlScan or RunAbsDiscrete, following the
+// layout in protocol/protocol.txt
+//
+// cmd may be framed or unframed. Fields the encoders don't expose are compared against
+// the constants they write and any differences are listed in Run.Unknown, so commands
+// captured from the vendor software can be checked for settings not yet understood.
+func DecodeRun(cmd []byte) (Run, error) {
+	if validFrame(cmd) {
+		cmd = cmd[4 : len(cmd)-3]
+	}
+	d := &decoder{b: cmd}
+	r := Run{}
+
+	if d.u8() != 0x04 {
+		return r, fmt.Errorf("not a run command")
+	}
+	d.plate(&r.Cfg.Plate)
+	optic := d.u8()
+	d.expect(0x00, 0x00, 0x00)
+	d.shaker(&r.Cfg.Shake)
+	d.expect(0x27, 0x0F, 0x27, 0x0F)
+	if d.err != nil {
+		return r, d.err
+	}
+
+	switch {
+	case optic&0x02 != 0:
+		abs := d.abs(&r.Cfg)
+		r.Abs = &abs
+	default:
+		fl, scan := d.fl(optic, &r.Cfg)
+		if scan != nil {
+			r.FlScan = scan
+		} else {
+			r.Fl = &fl
+		}
+	}
+	if d.err != nil {
+		return r, d.err
+	}
+	if d.i != len(d.b) {
+		return r, fmt.Errorf("%d unexpected trailing bytes", len(d.b)-d.i)
+	}
+
+	r.Unknown = d.unknown
+	return r, nil
+}
+
+// decoder walks a run command, the first error sticks
+type decoder struct {
+	b       []byte
+	i       int
+	err     error
+	unknown []UnknownField
+}
+
+// take returns the next n bytes
+func (d *decoder) take(n int) []byte {
+	if d.err != nil {
+		return make([]byte, n)
+	}
+	if d.i+n > len(d.b) {
+		d.err = fmt.Errorf("run command truncated at byte %d", len(d.b))
+		return make([]byte, n)
+	}
+	b := d.b[d.i : d.i+n]
+	d.i += n
+	return b
+}
+
+func (d *decoder) u8() int {
+	return int(d.take(1)[0])
+}
+
+func (d *decoder) u16() int {
+	return int(binary.BigEndian.Uint16(d.take(2)))
+}
+
+// expect consumes constant bytes, recording them as unknown when they differ
+func (d *decoder) expect(want ...byte) {
+	off := d.i
+	got := d.take(len(want))
+	if d.err == nil && !bytes.Equal(got, want) {
+		d.unknown = append(d.unknown, UnknownField{Offset: off, Got: bytes.Clone(got), Want: want})
+	}
+}
+
+// plate decodes the inverse of plateBytes, less the leading run byte
+func (d *decoder) plate(pl *PlateCfg) {
+	pl.Length = d.u16()
+	pl.Width = d.u16()
+	pl.CornerX = d.u16()
+	pl.CornerY = d.u16()
+
+	var dim [4]byte
+	binary.BigEndian.PutUint16(dim[0:], uint16(pl.Length-pl.CornerX))
+	binary.BigEndian.PutUint16(dim[2:], uint16(pl.Width-pl.CornerY))
+	d.expect(dim[:]...)
+
+	pl.Cols = d.u8()
+	pl.Rows = d.u8()
+	copy(pl.Wells[:], d.take(48))
+
+	// | uni-directional | start corner (3) | vertical/horizontal | flying mode | always set | 0 |
+	s := d.u8()
+	pl.Uni = s&(1<<7) != 0
+	pl.StartCorner = Corner(s>>4) & 0x07
+	pl.Vert = s&(1<<3) != 0
+	pl.FlyingMode = s&(1<<2) != 0
+}
+
+// shaker decodes the inverse of shakerBytes
+func (d *decoder) shaker(sh *ShakerCfg) {
+	b := d.take(4)
+	sh.Duration = int(binary.BigEndian.Uint16(b[2:4]))
+	if sh.Duration != 0 {
+		sh.Shake = ShakeType(b[0] & 0x0f)
+		sh.Speed = ShakeSpeed(b[1])
+	}
+}
+
+// pause decodes the pause before settings shared by the modalities
+func (d *decoder) pause(rc *RunCfg) {
+	d.u8() // pause enable, implied by a non zero time
+	rc.PauseTime = d.u16()
+}
+
+// fl decodes the remainder of a fluorescence command following the shaker, the scan
+// is set if the command is a spectral scan
+func (d *decoder) fl(optic int, rc *RunCfg) (FlCfg, *FlScan) {
+	fl := FlCfg{}
+	fl.BottomOptic = optic&(1<<6) != 0
+	fl.DualEm = optic&opticDualEm != 0
+
+	if optic&(1<<4|1<<5) != 0 {
+		d.expect(0x03)
+		fl.OrbitAvg = d.u8()
+		rc.Plate.WellDia = d.u16()
+		d.expect(0x00)
+	}
+
+	// deciseconds / 2, with 1 standing in for no settling
+	if st := d.u8(); st != 1 {
+		fl.SettlingTime = st / 5
+	}
+	fl.FocalHeight = d.u16()
+
+	d.expect(0x00, 0x00)
+	n := d.u8()
+	if (n == 0 || n > maxFlChromats) && d.err == nil {
+		d.err = fmt.Errorf("decoding %d multichromats is not supported", n)
+	}
+	var scan *FlScan
+	if t := ScanType(d.u8()); t != 0 {
+		scan = &FlScan{Scan: t}
+		scan.Stop, scan.Step = d.u16()/10, d.u16()/10
+	} else {
+		d.expect(0x00, 0x00, 0x00, 0x00)
+	}
+
+	for i := range n {
+		if d.err != nil {
+			break
+		}
+		ch := FlChromat{}
+		d.expect(0x0c)
+		ch.Gain = d.u16()
+		exHi, exLo := d.u16(), d.u16()
+		ch.Ex, ch.ExBw = (exHi+exLo)/20, (exHi-exLo)/2
+		ch.Dich = d.u16()
+		emHi, emLo := d.u16(), d.u16()
+		ch.Em, ch.EmBw = (emHi+emLo)/20, (emHi-emLo)/2
+		d.optics(&ch)
+		d.expect(0x00)
+		if i < n-1 {
+			d.expect(0x00, 0x00)
+		}
+		fl.Chromats = append(fl.Chromats, ch)
+	}
+
+	d.pause(rc)
+	if optic&opticTRF != 0 {
+		fl.TRF = &TRFCfg{IntegrationStart: d.u16(), IntegrationTime: d.u16()}
+	} else {
+		d.expect(0x00, 0x00, 0x00, 0x00)
+	}
+	d.expect(0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01)
+	fl.Flashes = d.u16()
+	d.expect(0x00, 0x4b, 0x00, 0x00)
+	if scan == nil || len(fl.Chromats) == 0 {
+		return fl, nil
+	}
+
+	ch := fl.Chromats[0]
+	scan.Ex, scan.ExBw, scan.Dich, scan.Em, scan.EmBw, scan.Gain = ch.Ex, ch.ExBw, ch.Dich, ch.Em, ch.EmBw, ch.Gain
+	if scan.Scan == ScanEx {
+		scan.Start, scan.Ex = ch.Ex, 0
+	} else {
+		scan.Start, scan.Em = ch.Em, 0
+	}
+	scan.FocalHeight, scan.Flashes, scan.BottomOptic, scan.SettlingTime = fl.FocalHeight, fl.Flashes, fl.BottomOptic, fl.SettlingTime
+	return fl, scan
+}
+
+// optics decodes the optics bytes of a chromat, values other than the known
+// monochromator and filter settings are recorded as unknown
+func (d *decoder) optics(ch *FlChromat) {
+	off := d.i
+	ex, em := d.u16(), d.u16()
+	known := func(v, mono int) bool { return v == mono || v == opticsFilter }
+	if d.err == nil && (!known(ex, opticsExMono) || !known(em, opticsEmMono)) {
+		d.unknown = append(d.unknown, UnknownField{Offset: off, Got: bytes.Clone(d.b[off:d.i]),
+			Want: HexBytes{0x00, opticsExMono, 0x00, opticsEmMono}})
+		return
+	}
+	ch.ExFilter = ex == opticsFilter
+	ch.EmFilter = em == opticsFilter
+}
+
+// abs decodes the remainder of a discrete absorbance command following the shaker
+func (d *decoder) abs(rc *RunCfg) DiscreteAbs {
+	abs := DiscreteAbs{}
+	d.expect(0x19)
+	n := d.u8()
+	for range n {
+		abs.Wavelengths = append(abs.Wavelengths, d.u16()/10)
+	}
+	d.expect(0x00, 0x00, 0x00, 0x64, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x64, 0x00)
+
+	d.pause(rc)
+	d.expect(0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01)
+	abs.Flashes = d.u16()
+	d.expect(0x00, 0x01, 0x00, 0x00)
+	return abs
+}
@@ -0,0 +1,85 @@
+package bmg
+
+import (
+	"reflect"
+	"slices"
+	"testing"
+)
+
+func TestDecodeRunRoundTrip(t *testing.T) {
+	pl := PlateCfg{
+		Length:      12776,
+		Width:       8548,
+		CornerX:     1438,
+		CornerY:     1124,
+		WellDia:     700,
+		Cols:        12,
+		Rows:        8,
+		StartCorner: BottomRight,
+		Vert:        true,
+	}
+	pl.SetWells(0, 1, 2, 3)
+	rc := RunCfg{
+		Plate:     pl,
+		Shake:     ShakerCfg{Shake: ShakeDoubleOrbital, Speed: Shake400, Duration: 30},
+		PauseTime: 12,
+	}
+	fl := FlCfg{
+		Chromats: []FlChromat{
+			{Ex: 483, ExBw: 14, Dich: 5025, Em: 530, EmBw: 30, Gain: 3000},
+			{Ex: 580, ExBw: 16, Dich: 6000, Em: 625, EmBw: 20, Gain: 2200},
+			{Ex: 485, ExBw: 20, Dich: 5100, Em: 535, EmBw: 25, Gain: 1800, ExFilter: true, EmFilter: true},
+		},
+		FocalHeight: 40, Flashes: 50, BottomOptic: true, SettlingTime: 4, OrbitAvg: 3}
+
+	cmd, err := flBytes(rc, fl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := DecodeRun(frame(cmd))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Fl == nil || !reflect.DeepEqual(*r.Fl, fl) || r.Cfg.Shake != rc.Shake || r.Cfg.PauseTime != 12 || r.Cfg.Plate != pl {
+		t.Fatalf("decoded run differs: %+v %+v", r.Cfg, r.Fl)
+	}
+	if len(r.Unknown) != 0 {
+		t.Fatalf("unexpected unknown fields %+v", r.Unknown)
+	}
+}
+
+func TestDecodeRunCaptures(t *testing.T) {
+	for _, exp := range [][]byte{flExp, absExp} {
+		r, err := DecodeRun(exp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var b []byte
+		if r.Abs != nil {
+			b, err = absDiscreteBytes(r.Cfg, *r.Abs)
+		} else {
+			b, err = flBytes(r.Cfg, *r.Fl)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(b, exp) {
+			t.Fatalf("re-encoded command differs\n% x\n% x", b, exp)
+		}
+	}
+}
+
+func TestDecodeRunUnknown(t *testing.T) {
+	cmd := slices.Clone(absExp)
+	cmd[89] = 0x65
+	r, err := DecodeRun(cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Unknown) != 1 || r.Unknown[0].Offset != 86 {
+		t.Fatalf("unexpected unknown fields %+v", r.Unknown)
+	}
+	if !slices.Equal(r.Abs.Wavelengths, []int{230, 260, 280, 340}) || r.Abs.Flashes != 22 {
+		t.Fatalf("unexpected abs config %+v", r.Abs)
+	}
+}
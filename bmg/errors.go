@@ -0,0 +1,104 @@
+package bmg
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// Errors reported by the plate reader, match them with errors.Is. They are wrapped in
+// an *InstrumentError carrying the command and error code.
+var (
+	ErrRejected         = errors.New("command rejected by instrument") // matches every InstrumentError
+	ErrInvalidParameter = errors.New("invalid parameter")
+	ErrNotInitialized   = errors.New("instrument not initialized")
+	ErrLidOpen          = errors.New("lid open")
+	ErrNoPlate          = errors.New("no plate detected")
+	ErrTrayOpen         = errors.New("tray open")
+)
+
+// error codes reported in status byte 5
+//
+// Experimental: that byte 5 holds an error code and these assignments are guesses, no
+// rejection reply has been captured. Commands only fail on them with the Experimental
+// option, otherwise a non-zero byte 5 is logged. Unknown codes are always just logged.
+var errorCodes = map[byte]error{
+	0x01: ErrInvalidParameter,
+	0x02: ErrNotInitialized,
+	0x03: ErrLidOpen,
+	0x04: ErrNoPlate,
+	0x05: ErrTrayOpen,
+}
+
+// InstrumentError is a failure reported by the plate reader
+type InstrumentError struct {
+	Cmd  string // name of the command that failed
+	Code byte   // error code from the status, 0 when inferred from the status flags
+	Err  error  // the matching sentinel, ErrRejected for unknown codes
+}
+
+func (e *InstrumentError) Error() string {
+	if e.Code == 0 {
+		return fmt.Sprintf("%s: %s", e.Cmd, e.Err)
+	}
+	return fmt.Sprintf("%s: %s (code 0x%02x)", e.Cmd, e.Err, e.Code)
+}
+
+func (e *InstrumentError) Unwrap() error {
+	return e.Err
+}
+
+// Is matches ErrRejected for every instrument error
+func (e *InstrumentError) Is(target error) bool {
+	return target == ErrRejected
+}
+
+// names of the known commands, keyed by their first byte
+var cmdNames = map[byte]string{
+	0x01: "init",
+	0x03: "tray",
+	0x04: "run",
+	0x05: "data",
+	0x0b: "stop",
+	0x80: "status",
+}
+
+// cmdName names a command for errors and logs
+func cmdName(cmd []byte) string {
+	if len(cmd) == 0 {
+		return "empty"
+	}
+	if n, ok := cmdNames[cmd[0]]; ok {
+		return n
+	}
+	return fmt.Sprintf("0x%02x", cmd[0])
+}
+
+// replyError returns the error reported in a status shaped reply to cmd, if any
+func replyError(cmd, resp []byte) error {
+	if len(resp) != 17 || resp[5] == 0 {
+		return nil
+	}
+	err, ok := errorCodes[resp[5]]
+	if !ok {
+		err = ErrRejected
+	}
+	return &InstrumentError{Cmd: cmdName(cmd), Code: resp[5], Err: err}
+}
+
+// readyError checks the status flags for conditions preventing a measurement, only
+// with CheckReady set
+func readyError(s Status) error {
+	var err error
+	switch {
+	case slices.Contains(s.Flags, FlagLidOpen):
+		err = ErrLidOpen
+	case slices.Contains(s.Flags, FlagOpen):
+		err = ErrTrayOpen
+	case !slices.Contains(s.Flags, FlagPlateDetected):
+		err = ErrNoPlate
+	default:
+		return nil
+	}
+	return &InstrumentError{Cmd: "run", Err: err}
+}
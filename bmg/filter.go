@@ -0,0 +1,92 @@
+package bmg
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Filter is an optical filter installed in one of the filter slides
+type Filter struct {
+	Name string `json:"name"` // e.g. F485, as labelled on the slide or in the vendor software
+	Slot int    `json:"slot"` // position in the slide, counting from 1
+	Wl   int    `json:"wl"`   // center wavelength (nm), dichroics are wavelength * 10 as in FlChromat.Dich
+	Bw   int    `json:"bw"`   // bandwidth (nm), 0 for dichroics
+}
+
+// FilterInventory lists the filters installed in the excitation, dichroic and emission
+// slides
+//
+// the instrument seems to identify filters by wavelength rather than slot, so reading by
+// slot needs the inventory to know what sits there.
+//
+// Experimental: filter chromats need the Experimental option, see opticsFilter.
+type FilterInventory struct {
+	Ex   []Filter `json:"ex"`
+	Dich []Filter `json:"dich"`
+	Em   []Filter `json:"em"`
+}
+
+// Chromat returns a filter based chromat reading through the named filters, each given
+// by name or slot number (e.g. "F485" or "2")
+//
+// an empty ex or em leaves that side on the monochromator, its wavelength and bandwidth
+// are then set on the returned chromat. An empty dich leaves Dich to be set as well.
+func (inv FilterInventory) Chromat(ex, dich, em string, gain int) (FlChromat, error) {
+	ch := FlChromat{Gain: gain}
+	if ex != "" {
+		f, err := findFilter(inv.Ex, "excitation", ex)
+		if err != nil {
+			return FlChromat{}, err
+		}
+		ch.Ex, ch.ExBw, ch.ExFilter = f.Wl, f.Bw, true
+	}
+	if dich != "" {
+		f, err := findFilter(inv.Dich, "dichroic", dich)
+		if err != nil {
+			return FlChromat{}, err
+		}
+		ch.Dich = f.Wl
+	}
+	if em != "" {
+		f, err := findFilter(inv.Em, "emission", em)
+		if err != nil {
+			return FlChromat{}, err
+		}
+		ch.Em, ch.EmBw, ch.EmFilter = f.Wl, f.Bw, true
+	}
+	return ch, nil
+}
+
+// findFilter looks up a filter in a slide by name or slot
+func findFilter(slide []Filter, kind, ref string) (Filter, error) {
+	slot, err := strconv.Atoi(ref)
+	for _, f := range slide {
+		if f.Name == ref || err == nil && f.Slot == slot {
+			return f, nil
+		}
+	}
+	return Filter{}, fmt.Errorf("no %s filter %q installed", kind, ref)
+}
+
+// optics bytes following each chromat, one uint16 per side
+//
+// the monochromators write 0x0004 (ex) and 0x0003 (em), probably slit settings. The
+// bytes were noted to differ when reading through filters but not by which filter, no
+// filter run was kept so 0x0000 for a filter is a guess.
+const (
+	opticsExMono = 0x0004
+	opticsEmMono = 0x0003
+	opticsFilter = 0x0000
+)
+
+// optics returns the optics bytes of ch
+func (ch FlChromat) optics() (ex, em uint16) {
+	ex, em = opticsExMono, opticsEmMono
+	if ch.ExFilter {
+		ex = opticsFilter
+	}
+	if ch.EmFilter {
+		em = opticsFilter
+	}
+	return ex, em
+}
@@ -0,0 +1,38 @@
+package bmg
+
+import "testing"
+
+func TestFilterInventory(t *testing.T) {
+	inv := FilterInventory{
+		Ex:   []Filter{{Name: "F485", Slot: 1, Wl: 485, Bw: 20}, {Name: "F544", Slot: 2, Wl: 544, Bw: 15}},
+		Dich: []Filter{{Name: "LP504", Slot: 1, Wl: 5040}},
+		Em:   []Filter{{Name: "F520", Slot: 1, Wl: 520, Bw: 25}},
+	}
+
+	ch, err := inv.Chromat("2", "LP504", "F520", 1500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := FlChromat{Ex: 544, ExBw: 15, Dich: 5040, Em: 520, EmBw: 25, Gain: 1500, ExFilter: true, EmFilter: true}
+	if ch != want {
+		t.Fatalf("got %+v, want %+v", ch, want)
+	}
+
+	// emission left on the monochromator
+	ch, err = inv.Chromat("F485", "1", "", 1500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ch.ExFilter || ch.EmFilter || ch.Ex != 485 || ch.Em != 0 {
+		t.Fatalf("unexpected chromat %+v", ch)
+	}
+	if ex, em := ch.optics(); ex != opticsFilter || em != opticsEmMono {
+		t.Fatalf("unexpected optics %04x %04x", ex, em)
+	}
+
+	for _, ref := range []string{"F590", "3"} {
+		if _, err := inv.Chromat(ref, "", "", 1500); err == nil {
+			t.Fatalf("missing filter %s accepted", ref)
+		}
+	}
+}
@@ -2,46 +2,105 @@
 package bmg
 
 import (
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"slices"
 )
 
 /*
 TODO:
-- Multichromatics (currently only 1), easy
 - Plate mode (currently endpoint only), need to implement injection system to justify kinetics
-- Spectral scan
-- Filter based (currently only monochrometer), easy
-- Time resolved
 - Fluorescence Polarization
 */
 
+// FlChromat is an excitation/emission pair measured in every well
+type FlChromat struct {
+	Ex   int `json:"ex"`    // excitation center wavelength
+	ExBw int `json:"ex_bw"` // excitation bandwidith
+	Dich int `json:"dich"`  // dichroic wavelength * 10
+	Em   int `json:"em"`    // emission center wavelength
+	EmBw int `json:"em_bw"` // emission bandwidth
+	Gain int `json:"gain"`  // gain
+
+	// read through the filter of this wavelength and bandwidth rather than the
+	// monochromator, see FilterInventory to select filters by name or slot.
+	// Experimental: needs the Experimental option, see opticsFilter
+	ExFilter bool `json:"ex_filter,omitempty"`
+	EmFilter bool `json:"em_filter,omitempty"`
+}
+
 // FlCfg is used to confgiure an endpoint fluorescence run
 type FlCfg struct {
-	Ex           int  `json:"ex"`            // excitation center wavelength
-	ExBw         int  `json:"ex_bw"`         // excitation bandwidith
-	Dich         int  `json:"dich"`          // dichroic wavelength * 10
-	Em           int  `json:"em"`            // emission center wavelength
-	EmBw         int  `json:"em_bw"`         // emission bandwidth
-	Gain         int  `json:"gain"`          // gain
-	FocalHeight  int  `json:"focal_height"`  // focal height (mm) * 100
-	Flashes      int  `json:"flashes"`       // number of flashes 0-200, 1-3 when using FlyingMode (off by default)
-	BottomOptic  bool `json:"bottom_optic"`  // use bottom optic, defaults to top optic
-	SettlingTime int  `json:"settling_time"` // 0-10 deciseconds
-	OrbitAvg     int  `json:"orbit_avg"`     // orbital averaging diameter (if > 0)
+	Chromats     []FlChromat `json:"chromats"`          // 1-5 multichromats, measured in order. Experimental beyond 1
+	FocalHeight  int         `json:"focal_height"`      // focal height (mm) * 100
+	Flashes      int         `json:"flashes"`           // number of flashes 0-200, 1-3 when using FlyingMode (off by default)
+	BottomOptic  bool        `json:"bottom_optic"`      // use bottom optic, defaults to top optic
+	SettlingTime int         `json:"settling_time"`     // 0-10 deciseconds
+	OrbitAvg     int         `json:"orbit_avg"`         // orbital averaging diameter (if > 0)
+	TRF          *TRFCfg     `json:"trf,omitempty"`     // time resolved read, prompt if nil
+	DualEm       bool        `json:"dual_em,omitempty"` // read both chromats simultaneously, experimental, see TRFRETCfg
 }
 
-// RunFl launches a fluorescence run, blocking
-func (c *Clario) RunFl(rc RunCfg, fl FlCfg) (FlData, error) {
+// RunFl launches a fluorescence run, blocking until the data is read or ctx is done
+//
+// if the run is stopped by Abort the values measured so far are returned with ErrAborted
+//
+// only single chromat runs have been captured, more chromats need the Experimental
+// option as the order of their values in the response is guessed (see unmarshalFl).
+func (c *Clario) RunFl(ctx context.Context, rc RunCfg, fl FlCfg) (FlData, error) {
 	cmd, err := flBytes(rc, fl)
 	if err != nil {
 		return FlData{}, err
 	}
-	c.setup()
-	c.waitForReady()
-	c.write(cmd)
-	c.waitForReady()
-	resp, err := c.write(getData)
+	c.checkModule(ModuleFluorescence)
+	if len(fl.Chromats) > 1 {
+		if err := c.allow("multichromat fluorescence"); err != nil {
+			return FlData{}, err
+		}
+	}
+	for _, ch := range fl.Chromats {
+		if ch.ExFilter || ch.EmFilter {
+			if err := c.allow("filter fluorescence"); err != nil {
+				return FlData{}, err
+			}
+			c.checkModule(ModuleFilters)
+			break
+		}
+	}
+	if fl.TRF != nil {
+		if err := c.allow("time resolved fluorescence"); err != nil {
+			return FlData{}, err
+		}
+		c.checkModule(ModuleTRF)
+	}
+	if fl.DualEm {
+		if err := c.allow("dual emission fluorescence"); err != nil {
+			return FlData{}, err
+		}
+	}
+	end, err := c.begin("fluorescence run")
+	if err != nil {
+		return FlData{}, err
+	}
+	defer end()
+
+	if err := c.prepare(ctx); err != nil {
+		return FlData{}, err
+	}
+	merr := c.measure(ctx, cmd)
+	switch {
+	case errors.Is(merr, ErrAborted):
+		// hand back whatever was measured before the abort
+		s, err := c.GetStatus(ctx)
+		if err != nil || !slices.Contains(s.Flags, FlagUnreadData) {
+			return FlData{}, merr
+		}
+	case merr != nil:
+		return FlData{}, merr
+	}
+	resp, err := c.readData(ctx)
 	if err != nil {
 		return FlData{}, err
 	}
@@ -49,12 +108,22 @@ func (c *Clario) RunFl(rc RunCfg, fl FlCfg) (FlData, error) {
 	if err != nil {
 		return FlData{}, err
 	}
-	return r, nil
+	r.Instrument = c.identity()
+	return r, merr
 
 }
 
 // flBytes serializes the FlCfg and implements basic sanity checks
 func flBytes(rc RunCfg, fl FlCfg) ([]byte, error) {
+	return flCmd(rc, fl, nil)
+}
+
+// flCmd serializes a fluorescence run, scan is the 5 byte scan block of a spectral
+// scan (see FlScan) and nil for an endpoint read
+func flCmd(rc RunCfg, fl FlCfg, scan []byte) ([]byte, error) {
+	if l := len(fl.Chromats); l == 0 || l > maxFlChromats {
+		return nil, fmt.Errorf("invalid number of chromats (must be 1-%d)", maxFlChromats)
+	}
 
 	// Flashes constraints
 	if rc.Plate.FlyingMode {
@@ -68,6 +137,24 @@ func flBytes(rc RunCfg, fl FlCfg) ([]byte, error) {
 	if fl.Flashes > 200 {
 		return nil, fmt.Errorf("flashes per well must be ")
 	}
+	if fl.TRF != nil {
+		if err := fl.TRF.check(); err != nil {
+			return nil, err
+		}
+		if fl.Flashes == 0 {
+			return nil, fmt.Errorf("time resolved reads need at least one flash")
+		}
+	}
+	if fl.DualEm {
+		// the detectors share the excitation light path
+		a, b := fl.Chromats[0], fl.Chromats[len(fl.Chromats)-1]
+		switch {
+		case len(fl.Chromats) != 2:
+			return nil, fmt.Errorf("dual emission needs exactly two chromats")
+		case a.Ex != b.Ex || a.ExBw != b.ExBw || a.Dich != b.Dich || a.ExFilter != b.ExFilter:
+			return nil, fmt.Errorf("dual emission chromats must share excitation and dichroic")
+		}
+	}
 
 	// Orbital averaging constraints
 	if fl.OrbitAvg > 0 {
@@ -81,12 +168,16 @@ func flBytes(rc RunCfg, fl FlCfg) ([]byte, error) {
 		}
 	}
 
-	cmd := make([]byte, 0, 125)
+	cmd := make([]byte, 0, 105+len(fl.Chromats)*22)
 
 	pb, err := plateBytes(rc.Plate)
 	if err != nil {
 		return nil, err
 	}
+	if scan != nil {
+		// the discrete bit isn't set in spectra
+		pb[len(pb)-1] &^= 1 << 1
+	}
 	cmd = append(cmd, pb...)
 
 	var d uint8
@@ -96,6 +187,12 @@ func flBytes(rc RunCfg, fl FlCfg) ([]byte, error) {
 	if fl.OrbitAvg > 0 {
 		d |= 1<<4 | 1<<5
 	}
+	if fl.TRF != nil {
+		d |= opticTRF
+	}
+	if fl.DualEm {
+		d |= opticDualEm
+	}
 	cmd = append(cmd, d)
 
 	//cmd[65:68] always zero
@@ -124,22 +221,33 @@ func flBytes(rc RunCfg, fl FlCfg) ([]byte, error) {
 	}
 	cmd = binary.BigEndian.AppendUint16(cmd, uint16(fl.FocalHeight))
 
-	// TODO multichromatic and filters
-	// 0x01 seems to be number of multichromats/filters
-	// when multichromats > 1 all but the last seems to have the gain and filter config
-	// plus 0x00,0x04,0x00,0x03 followed by 0x00 0x00 0x00 0x0c
-	cmd = append(cmd, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x0c)
-
-	cmd = binary.BigEndian.AppendUint16(cmd, uint16(fl.Gain))
-	cmd = binary.BigEndian.AppendUint16(cmd, uint16(fl.Ex*10+fl.ExBw))
-	cmd = binary.BigEndian.AppendUint16(cmd, uint16(fl.Ex*10-fl.ExBw))
-	cmd = binary.BigEndian.AppendUint16(cmd, uint16(fl.Dich))
-	cmd = binary.BigEndian.AppendUint16(cmd, uint16(fl.Em*10+fl.EmBw))
-	cmd = binary.BigEndian.AppendUint16(cmd, uint16(fl.Em*10-fl.EmBw))
-
-	// Probably something to do with the slits on the monochrometers? differ with filter measurement
-	// but not by which filter.
-	cmd = append(cmd, 0x00, 0x04, 0x00, 0x03, 0x00)
+	// number of multichromats/filters, each starts with 0x0c followed by its gain and
+	// filter config. All but the last are followed by the optics bytes and 0x00 0x00 0x00
+	cmd = append(cmd, 0x00, 0x00, byte(len(fl.Chromats)))
+	if scan == nil {
+		scan = make([]byte, 5)
+	}
+	cmd = append(cmd, scan...)
+
+	for i, ch := range fl.Chromats {
+		cmd = append(cmd, 0x0c)
+		cmd = binary.BigEndian.AppendUint16(cmd, uint16(ch.Gain))
+		cmd = binary.BigEndian.AppendUint16(cmd, uint16(ch.Ex*10+ch.ExBw))
+		cmd = binary.BigEndian.AppendUint16(cmd, uint16(ch.Ex*10-ch.ExBw))
+		cmd = binary.BigEndian.AppendUint16(cmd, uint16(ch.Dich))
+		cmd = binary.BigEndian.AppendUint16(cmd, uint16(ch.Em*10+ch.EmBw))
+		cmd = binary.BigEndian.AppendUint16(cmd, uint16(ch.Em*10-ch.EmBw))
+
+		// Probably something to do with the slits on the monochrometers? differ with filter measurement
+		// but not by which filter.
+		ex, em := ch.optics()
+		cmd = binary.BigEndian.AppendUint16(cmd, ex)
+		cmd = binary.BigEndian.AppendUint16(cmd, em)
+		cmd = append(cmd, 0x00)
+		if i < len(fl.Chromats)-1 {
+			cmd = append(cmd, 0x00, 0x00)
+		}
+	}
 
 	if rc.PauseTime != 0 {
 		cmd = append(cmd, 0x01)
@@ -148,7 +256,8 @@ func flBytes(rc RunCfg, fl FlCfg) ([]byte, error) {
 	}
 	cmd = binary.BigEndian.AppendUint16(cmd, uint16(rc.PauseTime))
 
-	cmd = append(cmd, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01)
+	cmd = append(cmd, trfBytes(fl.TRF)...)
+	cmd = append(cmd, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01)
 
 	cmd = binary.BigEndian.AppendUint16(cmd, uint16(fl.Flashes))
 	cmd = append(cmd, 0x00, 0x4b, 0x00, 0x00)
@@ -158,17 +267,23 @@ func flBytes(rc RunCfg, fl FlCfg) ([]byte, error) {
 
 // Fldata holds all of the known fields from the plate reader response
 type FlData struct {
-	Total         int      `json:"total"`         // total number of values the run will produce
-	Complete      int      `json:"complete"`      // number of completed measurements
-	Multichromats int      `json:"multichromats"` // number of multichromats used per well (currently 1 in fl)
-	Wells         int      `json:"wells"`         // number of wells measured
-	Temp          float32  `json:"temp"`          // the temperature of the incubator if enabled
-	Ovf           uint32   `json:"ovf"`           // overflow value
-	Vals          []uint32 `json:"vals"`          // all values measured, in row major order
+	Total         int        `json:"total"`                // total number of values the run will produce
+	Complete      int        `json:"complete"`             // number of completed measurements
+	Multichromats int        `json:"multichromats"`        // number of multichromats used per well
+	Wells         int        `json:"wells"`                // number of wells measured
+	Temp          float32    `json:"temp"`                 // the temperature of the incubator if enabled
+	Ovf           uint32     `json:"ovf"`                  // overflow value
+	Vals          [][]uint32 `json:"vals"`                 // values measured, [well][chromat] wells are row major order
+	Instrument    *Identity  `json:"instrument,omitempty"` // the instrument measuring, if identified
 }
 
 // unmarshalFlData populates a FlData from the plate reader response bytes
 func unmarshalFlData(resp []byte) (FlData, error) {
+	return unmarshalFl(resp, maxFlChromats)
+}
+
+// unmarshalFl decodes a 0x21 response of up to maxPer values per well
+func unmarshalFl(resp []byte, maxPer int) (FlData, error) {
 
 	if len(resp) < 34 {
 		return FlData{}, fmt.Errorf("malformed data response, too short")
@@ -181,23 +296,32 @@ func unmarshalFlData(resp []byte) (FlData, error) {
 	d := FlData{}
 	d.Total = int(binary.BigEndian.Uint16(resp[7:9]))
 	d.Complete = int(binary.BigEndian.Uint16(resp[9:11]))
-	d.Vals = make([]uint32, d.Complete)
 	d.Ovf = binary.BigEndian.Uint32(resp[11:15])
 
 	d.Multichromats = int(binary.BigEndian.Uint16(resp[16:18]))
 	d.Wells = int(binary.BigEndian.Uint16(resp[18:20]))
 	d.Temp = float32(binary.BigEndian.Uint16(resp[25:27]) / 10)
 
-	for i, j := 34, 0; j < d.Complete; {
-
+	// the counts come from the instrument, check them before allocating
+	switch {
+	case d.Wells > maxWells || d.Multichromats > maxPer:
+		return FlData{}, fmt.Errorf("malformed data response, implausible %d wells of %d chromats", d.Wells, d.Multichromats)
+	case d.Complete > d.Total || d.Total > d.Wells*d.Multichromats:
+		return FlData{}, fmt.Errorf("malformed data response, %d of %d values for %d wells of %d chromats",
+			d.Complete, d.Total, d.Wells, d.Multichromats)
+	case 34+d.Complete*4 > len(resp):
 		// the resp is not large enough to contain more responses even though they are expected
-		if i+4 > len(resp) {
-			return FlData{}, fmt.Errorf("expected data, but received none")
-		}
-		d.Vals[j] = binary.BigEndian.Uint32(resp[i : i+4])
+		return FlData{}, fmt.Errorf("expected data, but received none")
+	}
 
-		i += 4
-		j++
+	// values are taken to be chromat major as in absorbance, unconfirmed as no response
+	// of more than one chromat has been captured. A partial read holds the first
+	// Complete values, only wells with at least one value measured are included.
+	d.Vals = make([][]uint32, min(d.Wells, d.Complete))
+	for j := range d.Complete {
+		i := 34 + j*4
+		w := j % d.Wells
+		d.Vals[w] = append(d.Vals[w], binary.BigEndian.Uint32(resp[i:i+4]))
 	}
 
 	return d, nil
@@ -30,12 +30,14 @@ func TestFl(t *testing.T) {
 		StartCorner: TopLeft,
 	}
 	fl := FlCfg{
-		Ex:           550,
-		ExBw:         20,
-		Em:           605,
-		EmBw:         40,
-		Dich:         5725,
-		Gain:         3562,
+		Chromats: []FlChromat{{
+			Ex:   550,
+			ExBw: 20,
+			Em:   605,
+			EmBw: 40,
+			Dich: 5725,
+			Gain: 3562,
+		}},
 		FocalHeight:  40,
 		Flashes:      100,
 		SettlingTime: 5,
@@ -60,7 +62,7 @@ var flUnmarshalExp = FlData{
 	Wells:         3,
 	Temp:          0,
 	Ovf:           260000,
-	Vals:          []uint32{67697, 67490, 67935},
+	Vals:          [][]uint32{{67697}, {67490}, {67935}},
 }
 
 func TestUnmarshalFlData(t *testing.T) {
@@ -77,4 +79,33 @@ func TestUnmarshalFlData(t *testing.T) {
 	if !reflect.DeepEqual(flUnmarshalExp, d) {
 		t.Fail()
 	}
+
+	// more multichromats than a run can measure
+	bad := slices.Clone(data)
+	bad[17] = maxFlChromats + 1
+	if _, err := unmarshalFlData(bad); err == nil {
+		t.Fatal("implausible multichromat count accepted")
+	}
+}
+
+func FuzzUnmarshalFlData(f *testing.F) {
+	resp := make([]byte, 34, 47)
+	resp[6] = 0x21
+	resp[8], resp[10], resp[17], resp[19] = 3, 3, 1, 3
+	resp = append(resp, 0x00, 0x01, 0x08, 0x71, 0x00, 0x01, 0x07, 0xa2, 0x00, 0x01, 0x09, 0x5f, 0x00)
+	f.Add(resp)
+
+	f.Fuzz(func(t *testing.T, resp []byte) {
+		d, err := unmarshalFlData(resp)
+		if err != nil {
+			return
+		}
+		n := 0
+		for _, w := range d.Vals {
+			n += len(w)
+		}
+		if n != d.Complete || d.Complete > d.Total || len(d.Vals) > d.Wells {
+			t.Fatalf("inconsistent data %d values in %d wells, %d of %d complete", n, len(d.Vals), d.Complete, d.Total)
+		}
+	})
 }
@@ -0,0 +1,168 @@
+package bmg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// FrameStats counts what the frame reader has received and thrown away
+type FrameStats struct {
+	Frames    int `json:"frames"`    // valid frames read
+	Discarded int `json:"discarded"` // bytes skipped while scanning for a frame
+	Framing   int `json:"framing"`   // candidate frames rejected for size, NP or terminator
+	Checksum  int `json:"checksum"`  // frames rejected for an invalid checksum
+	Flushed   int `json:"flushed"`   // buffered bytes dropped by Resync
+}
+
+// frameReader is a streaming frame parser
+//
+// bytes are buffered as they are read from the transport and frames are pulled from
+// the front of the buffer. Anything that doesn't validate is skipped by scanning for
+// the next STX, so the stream recovers on its own after corrupt bytes.
+type frameReader struct {
+	r       io.Reader
+	scratch []byte
+
+	mu    sync.Mutex
+	buf   []byte
+	stats FrameStats
+}
+
+func newFrameReader(r io.Reader) *frameReader {
+	return &frameReader{r: r, scratch: make([]byte, 4096)}
+}
+
+// readFrame reads until a complete frame is buffered and returns it unframed,
+// ErrChecksumInvalid is returned for a whole frame with a bad checksum
+func (fr *frameReader) readFrame() ([]byte, error) {
+	for {
+		fr.mu.Lock()
+		data, ok, err := fr.next()
+		fr.mu.Unlock()
+		if ok {
+			return data, err
+		}
+
+		n, err := fr.r.Read(fr.scratch)
+		fr.mu.Lock()
+		fr.buf = append(fr.buf, fr.scratch[:n]...)
+		fr.mu.Unlock()
+		if err != nil {
+			return nil, fmt.Errorf("read error: %w", err)
+		}
+	}
+}
+
+// next pulls the first frame from the buffer, ok is false if more bytes are needed
+//
+// STX | uint16 (size) | NP | data | uint16 (CS) | CR
+func (fr *frameReader) next() (data []byte, ok bool, err error) {
+	for {
+		// scan for STX
+		i := bytes.IndexByte(fr.buf, 0x02)
+		if i < 0 {
+			fr.discard(len(fr.buf))
+			return nil, false, nil
+		}
+		fr.discard(i)
+
+		if len(fr.buf) < 4 {
+			return nil, false, nil
+		}
+		size := int(binary.BigEndian.Uint16(fr.buf[1:3]))
+		if fr.buf[3] != 0x0c || size < 7 {
+			fr.stats.Framing++
+			fr.discard(1)
+			continue
+		}
+
+		if len(fr.buf) < size {
+			// a complete frame further on means this STX was noise
+			if j := fr.validAfter(1, len(fr.buf)); j > 0 {
+				fr.stats.Framing++
+				fr.discard(j)
+				continue
+			}
+			return nil, false, nil
+		}
+
+		f := fr.buf[:size]
+		if f[size-1] != 0x0d {
+			fr.stats.Framing++
+			fr.discard(1)
+			continue
+		}
+		if binary.BigEndian.Uint16(f[size-3:size-1]) != checksum(f[:size-3]) {
+			if j := fr.validAfter(1, size); j > 0 {
+				fr.stats.Framing++
+				fr.discard(j)
+				continue
+			}
+			// looks like a real frame corrupted on the line, drop it whole
+			fr.stats.Checksum++
+			fr.buf = fr.buf[size:]
+			return nil, true, ErrChecksumInvalid
+		}
+
+		data = bytes.Clone(f[4 : size-3])
+		fr.buf = fr.buf[size:]
+		fr.stats.Frames++
+		return data, true, nil
+	}
+}
+
+// validAfter returns the offset of the first complete, valid frame starting in
+// buf[from:to], or -1
+func (fr *frameReader) validAfter(from, to int) int {
+	for k := from; k < to; k++ {
+		if fr.buf[k] == 0x02 && validFrame(fr.buf[k:]) {
+			return k
+		}
+	}
+	return -1
+}
+
+// discard drops n bytes from the front of the buffer
+func (fr *frameReader) discard(n int) {
+	fr.stats.Discarded += n
+	fr.buf = fr.buf[n:]
+}
+
+// flush drops everything buffered
+func (fr *frameReader) flush() {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	fr.stats.Flushed += len(fr.buf)
+	fr.buf = nil
+}
+
+// counters returns a copy of the stats
+func (fr *frameReader) counters() FrameStats {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	return fr.stats
+}
+
+// validFrame reports whether b begins with a complete frame passing every check
+func validFrame(b []byte) bool {
+	if len(b) < 7 || b[0] != 0x02 || b[3] != 0x0c {
+		return false
+	}
+	size := int(binary.BigEndian.Uint16(b[1:3]))
+	if size < 7 || size > len(b) || b[size-1] != 0x0d {
+		return false
+	}
+	return binary.BigEndian.Uint16(b[size-3:size-1]) == checksum(b[:size-3])
+}
+
+// checksum sums the header and data bytes
+func checksum(b []byte) uint16 {
+	var sum uint16
+	for _, v := range b {
+		sum += uint16(v)
+	}
+	return sum
+}
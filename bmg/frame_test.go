@@ -0,0 +1,98 @@
+package bmg
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"slices"
+	"testing"
+)
+
+func TestFrameReaderResync(t *testing.T) {
+	corrupt := frame([]byte{0x05, 0x06})
+	corrupt[5] ^= 0xff
+
+	var stream []byte
+	stream = append(stream, 0xaa, 0x0d, 0x00)                   // line noise
+	stream = append(stream, frame([]byte{0x01})...)             // valid
+	stream = append(stream, 0x02, 0x00, 0x03, 0x0c)             // size too small
+	stream = append(stream, corrupt...)                         // bad checksum
+	stream = append(stream, 0x02, 0xff, 0xff, 0x0c)             // claims a huge frame
+	stream = append(stream, frame([]byte{0x02, 0x03, 0x04})...) // valid
+
+	fr := newFrameReader(bytes.NewReader(stream))
+
+	got, err := fr.readFrame()
+	if err != nil || !slices.Equal(got, []byte{0x01}) {
+		t.Fatalf("first frame: %v %v", got, err)
+	}
+	if _, err := fr.readFrame(); !errors.Is(err, ErrChecksumInvalid) {
+		t.Fatalf("expected checksum error, got %v", err)
+	}
+	got, err = fr.readFrame()
+	if err != nil || !slices.Equal(got, []byte{0x02, 0x03, 0x04}) {
+		t.Fatalf("frame after resync: %v %v", got, err)
+	}
+	if _, err := fr.readFrame(); !errors.Is(err, io.EOF) {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+
+	s := fr.counters()
+	if s.Frames != 2 || s.Checksum != 1 || s.Framing != 2 || s.Discarded != 3+4+4 {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+}
+
+func TestResync(t *testing.T) {
+	cl, te := net.Pipe()
+	c := New(cl)
+	defer c.Close()
+
+	go func() {
+		// garbage and half a frame left on the line by a glitch
+		te.Write([]byte{0x02, 0x00, 0x40, 0x0c, 0x01})
+		buf := make([]byte, len(frame(cmdStatus)))
+		if _, err := io.ReadFull(te, buf); err != nil {
+			return
+		}
+		te.Write(statusResp)
+	}()
+
+	if err := c.Resync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if s := c.FrameStats(); s.Flushed != 5 || s.Frames != 1 {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+}
+
+// whatever is on the line, the frame reader must only hand out frames that validate and
+// must consume the stream without panicking
+func FuzzReadFrame(f *testing.F) {
+	f.Add(frame(cmdStatus))
+	f.Add(statusResp)
+	f.Add([]byte{0x02, 0x00, 0x03, 0x0c, 0x02, 0xff, 0xff, 0x0c})
+	f.Add(append([]byte{0x02, 0x00, 0x00, 0x0c}, frame([]byte{0x01})...))
+
+	f.Fuzz(func(t *testing.T, stream []byte) {
+		fr := newFrameReader(bytes.NewReader(stream))
+		for {
+			data, err := fr.readFrame()
+			if errors.Is(err, ErrChecksumInvalid) {
+				continue
+			}
+			if err != nil {
+				break
+			}
+			if !validFrame(frame(data)) {
+				t.Fatalf("invalid frame handed out % x", data)
+			}
+		}
+		s := fr.counters()
+		if s.Discarded > len(stream) {
+			t.Fatalf("discarded %d of %d bytes", s.Discarded, len(stream))
+		}
+	})
+}
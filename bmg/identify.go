@@ -0,0 +1,181 @@
+package bmg
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Module is an installed option reported by the instrument
+type Module string
+
+const (
+	ModuleAbsorbance   Module = "ABSORBANCE"
+	ModuleFluorescence Module = "FLUORESCENCE" // monochromator fluorescence
+	ModuleLuminescence Module = "LUMINESCENCE"
+	ModuleFilters      Module = "FILTERS" // filter slides for filter based fl and lum
+	ModuleAlphaScreen  Module = "ALPHASCREEN"
+	ModuleTRF          Module = "TRF" // time resolved fluorescence
+	ModuleFP           Module = "FP"  // fluorescence polarization
+	ModuleInjectors    Module = "INJECTORS"
+	ModuleACU          Module = "ACU" // atmospheric control unit (O2/CO2)
+	ModuleStacker      Module = "STACKER"
+	ModuleIncubator    Module = "INCUBATOR"
+)
+
+// bits of the installed module field of the eeprom reply, least significant first
+//
+// TODO: assignments are guessed, no eeprom reply has been captured
+var moduleBits = []Module{
+	ModuleAbsorbance,
+	ModuleFluorescence,
+	ModuleLuminescence,
+	ModuleFilters,
+	ModuleAlphaScreen,
+	ModuleTRF,
+	ModuleFP,
+	ModuleInjectors,
+	ModuleACU,
+	ModuleStacker,
+	ModuleIncubator,
+}
+
+// machine types reported in the eeprom reply
+var models = map[int]string{
+	0x0024: "CLARIOstar",
+	0x0026: "CLARIOstar Plus",
+}
+
+// identification requests, answered with the eeprom contents and firmware info
+// rather than a status. Neither opcode has been captured.
+var cmdEeprom = []byte{0x05, 0x07, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+var cmdFirmware = []byte{0x05, 0x09, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+
+// Identity describes the connected instrument
+type Identity struct {
+	Model    string   `json:"model"`
+	Hardware int      `json:"hardware"` // hardware revision
+	Serial   string   `json:"serial"`
+	Firmware string   `json:"firmware"` // firmware version, e.g. 1.35
+	Build    string   `json:"build"`    // firmware build date and time
+	Modules  []Module `json:"modules"`  // installed options
+	Eeprom   HexBytes `json:"eeprom"`   // the complete eeprom reply
+	Info     HexBytes `json:"info"`     // the complete firmware info reply
+}
+
+// Has reports whether module m is installed
+func (id Identity) Has(m Module) bool {
+	return slices.Contains(id.Modules, m)
+}
+
+// Identify queries the firmware version, serial number and installed modules
+//
+// the identity is kept for the life of the connection and the data of later runs is
+// tagged with it. Runs needing a module the identity lacks are logged but not refused,
+// refusing them waits on a capture confirming the module bits (see parseIdentity).
+//
+// Experimental: the requests and reply layouts are guessed, Identify fails with
+// ErrExperimental without the Experimental option.
+func (c *Clario) Identify(ctx context.Context) (Identity, error) {
+	if err := c.allow("identification"); err != nil {
+		return Identity{}, err
+	}
+	ee, err := c.write(ctx, cmdEeprom)
+	if err != nil {
+		return Identity{}, err
+	}
+	info, err := c.write(ctx, cmdFirmware)
+	if err != nil {
+		return Identity{}, err
+	}
+	id, err := parseIdentity(ee, info)
+	if err != nil {
+		return Identity{}, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.id = &id
+	return id, nil
+}
+
+// identity returns the identity found by Identify, nil if it hasn't been called
+func (c *Clario) identity() *Identity {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.id
+}
+
+// checkModule warns when an identified instrument doesn't report module m, the run is
+// left to the instrument to reject
+func (c *Clario) checkModule(m Module) {
+	if id := c.identity(); id != nil && !id.Has(m) {
+		c.log.Warn("module not reported by instrument", "module", m)
+	}
+}
+
+// parseIdentity decodes the eeprom and firmware info replies
+//
+// the layouts are guesses, no reply has been captured:
+//
+//	eeprom
+//	0     0x07, echoes the request
+//	1-5   unknown
+//	6-7   machine type
+//	8-9   hardware revision
+//	10-21 serial number, ascii padded with NUL
+//	22-23 installed module bit field
+//
+//	firmware info
+//	0     0x09, echoes the request
+//	1-5   unknown
+//	6-7   firmware version * 1000
+//	8-19  build date, ascii padded with NUL
+//	20-27 build time, ascii
+func parseIdentity(ee, info []byte) (Identity, error) {
+	for _, r := range []struct {
+		resp []byte
+		cmd  []byte
+		n    int
+	}{{ee, cmdEeprom, 24}, {info, cmdFirmware, 28}} {
+		// a status in place of the reply is a rejection
+		if err := replyError(r.cmd, r.resp); err != nil {
+			return Identity{}, err
+		}
+		if len(r.resp) < r.n || r.resp[0] != r.cmd[1] {
+			return Identity{}, fmt.Errorf("malformed identification response. got % x", r.resp)
+		}
+	}
+
+	id := Identity{
+		Hardware: int(binary.BigEndian.Uint16(ee[8:10])),
+		Serial:   cstring(ee[10:22]),
+		Firmware: fmt.Sprintf("%.2f", float64(binary.BigEndian.Uint16(info[6:8]))/1000),
+		Build:    strings.TrimSpace(cstring(info[8:20]) + " " + cstring(info[20:28])),
+		Eeprom:   slices.Clone(ee),
+		Info:     slices.Clone(info),
+	}
+	mt := int(binary.BigEndian.Uint16(ee[6:8]))
+	id.Model = models[mt]
+	if id.Model == "" {
+		id.Model = fmt.Sprintf("unknown (0x%04x)", mt)
+	}
+	bits := binary.BigEndian.Uint16(ee[22:24])
+	for i, m := range moduleBits {
+		if bits&(1<<i) != 0 {
+			id.Modules = append(id.Modules, m)
+		}
+	}
+	return id, nil
+}
+
+// cstring returns the ascii string in b up to the first NUL
+func cstring(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return strings.TrimSpace(string(b))
+}
@@ -0,0 +1,38 @@
+package bmg
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestParseIdentity(t *testing.T) {
+	ee := []byte{0x07, 0x05, 0x00, 0x00, 0x00, 0x00, 0x00, 0x26, 0x00, 0x02,
+		'4', '3', '0', '-', '1', '2', '3', '4', 0x00, 0x00, 0x00, 0x00, 0x00, 0x83}
+	info := append([]byte{0x09, 0x05, 0x00, 0x00, 0x00, 0x00, 0x05, 0x46},
+		[]byte("Nov 20 2020\x0011:51:21")...)
+
+	id, err := parseIdentity(ee, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.Model != "CLARIOstar Plus" || id.Hardware != 2 || id.Serial != "430-1234" {
+		t.Fatalf("unexpected eeprom fields %+v", id)
+	}
+	if id.Firmware != "1.35" || id.Build != "Nov 20 2020 11:51:21" {
+		t.Fatalf("unexpected firmware fields %+v", id)
+	}
+	if !slices.Equal(id.Modules, []Module{ModuleAbsorbance, ModuleFluorescence, ModuleInjectors}) {
+		t.Fatalf("unexpected modules %v", id.Modules)
+	}
+
+	// a status in place of the reply
+	status := []byte{0x01, 0x01, 0x00, 0x20, 0x00, 0x01, 0x03, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0xc0, 0x00}
+	if _, err := parseIdentity(status, info); !errors.Is(err, ErrInvalidParameter) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, err := parseIdentity(ee[:20], info); err == nil {
+		t.Fatal("expected error for short reply")
+	}
+}
@@ -0,0 +1,108 @@
+package bmg
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// another process has the serial port open, match with errors.Is. The holder is
+// reported in a *BusyError.
+var ErrInstrumentBusy = errors.New("instrument in use by another process")
+
+// LockHolder is the process holding the serial port, as written to its lock file
+type LockHolder struct {
+	PID   int       `json:"pid"`
+	Cmd   string    `json:"cmd"`
+	Start time.Time `json:"start"`
+}
+
+// BusyError is returned by OpenSerial when another process holds the serial port
+type BusyError struct {
+	Dev    string
+	Holder *LockHolder // nil when the lock file can't be read
+}
+
+func (e *BusyError) Error() string {
+	if e.Holder == nil {
+		return fmt.Sprintf("%s: %s", e.Dev, ErrInstrumentBusy)
+	}
+	return fmt.Sprintf("%s: %s (pid %d %q since %s)", e.Dev, ErrInstrumentBusy,
+		e.Holder.PID, e.Holder.Cmd, e.Holder.Start.Format(time.DateTime))
+}
+
+func (e *BusyError) Unwrap() error {
+	return ErrInstrumentBusy
+}
+
+// directory holding tty lock files by convention, the temporary directory is used on
+// systems without it
+const lockDir = "/run/lock"
+
+// lockPath returns the lock file for tty, symlinks such as /dev/clario share the lock
+// file of the device they point to
+func lockPath(tty string) string {
+	if p, err := filepath.EvalSymlinks(tty); err == nil {
+		tty = p
+	}
+	name := strings.ReplaceAll(strings.TrimPrefix(filepath.Clean(tty), "/"), "/", "-")
+	dir := lockDir
+	if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "bmg-"+name+".lock")
+}
+
+// writeLock records this process as the holder of the lock at path
+//
+// the file is informational only, exclusion is enforced on the tty itself so a file
+// left behind by a crashed process is simply overwritten. The lock directory is shared,
+// the contents go to a freshly created file renamed over path, so neither write follows
+// a link planted there.
+func writeLock(path string) error {
+	b, err := json.Marshal(LockHolder{
+		PID:   os.Getpid(),
+		Cmd:   strings.Join(os.Args, " "),
+		Start: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		// CreateTemp makes the file private, the holder is meant to be read by others
+		err = os.Chmod(f.Name(), 0o644)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// busyError describes the process holding tty from its lock file
+func busyError(tty string) error {
+	e := &BusyError{Dev: tty}
+	b, err := os.ReadFile(lockPath(tty))
+	if err != nil {
+		return e
+	}
+	var h LockHolder
+	if json.Unmarshal(b, &h) == nil {
+		e.Holder = &h
+	}
+	return e
+}
@@ -0,0 +1,40 @@
+package bmg
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// a link planted at the lock path is replaced, not written through
+func TestWriteLockSymlink(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "target")
+	if err := os.WriteFile(target, []byte("keep"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "bmg-dev-ttyUSB0.lock")
+	if err := os.Symlink(target, path); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writeLock(path); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(target); err != nil || string(b) != "keep" {
+		t.Fatalf("link target overwritten: %q %v", b, err)
+	}
+	fi, err := os.Lstat(path)
+	if err != nil || fi.Mode()&os.ModeSymlink != 0 || fi.Mode().Perm() != 0o644 {
+		t.Fatalf("lock file not replaced: %v %v", fi.Mode(), err)
+	}
+	b, _ := os.ReadFile(path)
+	var h LockHolder
+	if err := json.Unmarshal(b, &h); err != nil || h.PID != os.Getpid() {
+		t.Fatalf("unexpected holder %s", b)
+	}
+	if m, _ := filepath.Glob(path + ".*"); len(m) != 0 {
+		t.Fatalf("temporary files left behind %v", m)
+	}
+}
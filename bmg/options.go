@@ -0,0 +1,124 @@
+package bmg
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// Option configures a connection. Open takes every option, the transport constructors
+// and New apply the ones relevant to them and ignore the rest.
+type Option func(*options)
+
+// options collects the settings of a connection
+type options struct {
+	serial     serialCfg
+	cmdTimeout time.Duration
+	runTimeout time.Duration
+	stopRun    bool
+	checkReady bool
+	experiment bool
+	poll       time.Duration
+	log        *slog.Logger
+}
+
+// defaults suiting the CLARIOstar on its serial port
+func defaultOptions() options {
+	return options{
+		serial:     defaultSerialCfg(),
+		cmdTimeout: cmdTimeout,
+		poll:       pollInterval,
+		log:        slog.New(slog.DiscardHandler),
+	}
+}
+
+// collect applies opts over the defaults
+func collect(opts []Option) options {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// CmdTimeout sets how long to wait for the reply to a single command, 10s by default
+func CmdTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.cmdTimeout = d
+	}
+}
+
+// RunTimeout limits how long a measurement may take before it is stopped, as if its
+// context was cancelled. There is no limit by default.
+func RunTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.runTimeout = d
+	}
+}
+
+// StopOnCancel sends the stop command when a measurement is cancelled or exceeds
+// RunTimeout, waiting up to 30s for the instrument to come to rest. Without it a
+// cancelled run returns straight away and the instrument carries on measuring.
+//
+// the stop opcode has only been seen working on the simulator, it is not yet confirmed
+// on a capture.
+func StopOnCancel() Option {
+	return func(o *options) {
+		o.stopRun = true
+	}
+}
+
+// CheckReady refuses runs up front when the status flags show the lid or tray open or
+// no plate, rather than relying on the instrument to reject the run
+//
+// the flags are only partly understood, the status captured after initializing a
+// loaded instrument reads as OPEN, so this is off by default.
+func CheckReady() Option {
+	return func(o *options) {
+		o.checkReady = true
+	}
+}
+
+// a run relies on an unconfirmed encoding and the Experimental option isn't set
+var ErrExperimental = errors.New("experimental mode, enable with the Experimental option")
+
+// Experimental allows runs and commands whose encoding has been worked out without a capture
+// of the vendor software, they fail with ErrExperimental otherwise. Such modes are
+// marked Experimental in their docs, the instrument may reject or misread them.
+func Experimental() Option {
+	return func(o *options) {
+		o.experiment = true
+	}
+}
+
+// allow checks the named mode, relying on an unconfirmed encoding, may be sent
+func (c *Clario) allow(mode string) error {
+	if !c.experiment {
+		return fmt.Errorf("%w: %s", ErrExperimental, mode)
+	}
+	c.log.Warn("sending experimental command", "mode", mode)
+	return nil
+}
+
+// PollInterval sets how often the status is polled while waiting on the instrument,
+// 100ms by default. Slow kinetic runs can poll less often, the simulator more.
+func PollInterval(d time.Duration) Option {
+	return func(o *options) {
+		o.poll = d
+	}
+}
+
+// Logger sets the logger the connection reports to, nothing is logged by default
+func Logger(l *slog.Logger) Option {
+	return func(o *options) {
+		o.log = l
+	}
+}
+
+// SerialBaud sets the (possibly non-standard) baud rate, the CLARIOstar uses 125000
+func SerialBaud(baud int) Option {
+	return func(o *options) {
+		o.serial.baud = baud
+	}
+}
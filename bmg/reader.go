@@ -0,0 +1,190 @@
+package bmg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// number of stray frames buffered before new ones are dropped
+const strayBuffer = 16
+
+// quiet period Resync waits out before dropping buffered bytes
+const resyncQuiet = time.Millisecond * 100
+
+// reply is a frame, or the error reading it, handed to the outstanding command
+type reply struct {
+	data []byte
+	err  error
+}
+
+// StrayFrame is a frame received while no command was waiting for it
+type StrayFrame struct {
+	Time time.Time `json:"time"`
+	Data []byte    `json:"data"` // unframed payload
+	Late bool      `json:"late"` // most likely the reply to a command that timed out or was cancelled
+}
+
+// Stray returns frames that could not be matched to a command
+//
+// the plate reader only speaks when spoken to, so these are late replies or line noise.
+// Frames are dropped if the channel is not drained.
+func (c *Clario) Stray() <-chan StrayFrame {
+	return c.stray
+}
+
+// FrameStats returns counts of frames read and garbage discarded on the line
+func (c *Clario) FrameStats() FrameStats {
+	return c.fr.counters()
+}
+
+// Resync discards anything buffered on the line and confirms the instrument answers a
+// status request, for use after USB glitches or a run of checksum errors
+//
+// Resync waits for any exchange in flight to finish.
+func (c *Clario) Resync(ctx context.Context) error {
+	if err := c.lock(ctx); err != nil {
+		return err
+	}
+	defer c.unlock()
+	c.log.Info("resyncing", "frames", c.fr.counters())
+
+	if f, ok := c.f.(interface{ Flush() error }); ok {
+		if err := f.Flush(); err != nil {
+			return fmt.Errorf("error flushing transport: %w", err)
+		}
+	}
+
+	// let anything still on the wire arrive before dropping it
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(resyncQuiet):
+	}
+	c.mu.Lock()
+	c.late = false
+	c.mu.Unlock()
+	c.fr.flush()
+
+	resp, err := c.exchange(ctx, cmdStatus)
+	if err != nil {
+		return err
+	}
+	if len(resp) != 17 {
+		return fmt.Errorf("malformed status response. got %d bytes", len(resp))
+	}
+	return nil
+}
+
+// readLoop reads frames from the transport for the lifetime of the connection and
+// hands each one to the outstanding command
+func (c *Clario) readLoop() {
+	for {
+		data, err := c.fr.readFrame()
+		if errors.Is(err, ErrReconnected) {
+			c.reconnected()
+			continue
+		}
+		if err != nil && !errors.Is(err, ErrChecksumInvalid) {
+			c.log.Error("reader stopped", "err", err)
+			c.mu.Lock()
+			c.rerr = errors.Join(ErrClosed, err)
+			if c.pending != nil {
+				c.pending <- reply{err: c.rerr}
+				c.pending = nil
+			}
+			c.mu.Unlock()
+			return
+		}
+		if err == nil {
+			c.recorder().record(Rx, frame(data))
+		} else {
+			c.log.Warn("checksum error", "data", HexBytes(data))
+		}
+		c.deliver(reply{data: data, err: err})
+	}
+}
+
+// reconnected drops whatever was in flight when the transport was reopened, the
+// outstanding command fails with ErrReconnected rather than being resent
+func (c *Clario) reconnected() {
+	c.log.Warn("transport reopened, dropping the exchange in flight")
+	c.fr.flush()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.late = false
+	if c.pending != nil {
+		c.pending <- reply{err: ErrReconnected}
+		c.pending = nil
+	}
+}
+
+// deliver passes r to the outstanding command, replies owed to commands that gave up
+// are surfaced as stray frames instead
+func (c *Clario) deliver(r reply) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch {
+	case c.late:
+		// replies arrive in order, so the reply to the abandoned command comes first
+		c.late = false
+		if c.pending != nil {
+			c.ateLate = true
+		}
+		c.strayFrame(r, true)
+	case c.pending != nil:
+		c.pending <- r
+		c.pending = nil
+	default:
+		c.strayFrame(r, false)
+	}
+}
+
+// strayFrame queues r on the stray channel without blocking the reader
+func (c *Clario) strayFrame(r reply, late bool) {
+	if r.err != nil {
+		return
+	}
+	c.log.Warn("stray frame", "late", late, "data", HexBytes(r.data))
+	select {
+	case c.stray <- StrayFrame{Time: time.Now(), Data: r.data, Late: late}:
+	default:
+	}
+}
+
+// expect registers a command as waiting for the next frame
+func (c *Clario) expect() (chan reply, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.rerr != nil {
+		return nil, c.rerr
+	}
+	if c.pending != nil {
+		return nil, fmt.Errorf("command already in flight")
+	}
+	c.pending = make(chan reply, 1)
+	c.ateLate = false
+	return c.pending, nil
+}
+
+// abandon deregisters a command waiting on ch, returning its reply if one was handed
+// over in the meantime. When sent the reply is still owed and will be discarded as
+// late on arrival, unless a frame was already discarded in its place.
+func (c *Clario) abandon(ch chan reply, sent bool) (reply, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case r := <-ch:
+		return r, true
+	default:
+	}
+	if c.pending == ch {
+		c.pending = nil
+	}
+	// if a frame was discarded as late while waiting it was most likely this command's,
+	// the abandoned command never got a reply, don't keep discarding
+	c.late = sent && !c.ateLate
+	return reply{}, false
+}
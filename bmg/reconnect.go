@@ -0,0 +1,263 @@
+package bmg
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// the transport is being reopened, nothing was written
+var ErrDisconnected = errors.New("disconnected")
+
+// the transport was reopened, frames in flight were lost and the command waiting on
+// a reply (if any) fails with it. Commands are never resent, a run interrupted by a
+// reconnect has to be checked on and restarted by the caller.
+var ErrReconnected = errors.New("reconnected")
+
+// interval between attempts to reopen a transport
+const reconnectPoll = time.Millisecond * 500
+
+// Reconnect is a Transport that reopens the serial port when the adapter drops off the
+// bus, e.g. when the ftdi re-enumerates or ftdi_sio is rebound
+//
+// read and write errors such as EIO and ENODEV close the dead port and it is reopened,
+// with the serial configuration reapplied, once the tty reappears. The instrument must
+// answer a status request before the new port is used. Writes made while disconnected
+// fail with ErrDisconnected rather than being queued, and the reader of the transport
+// sees ErrReconnected once the port is back.
+type Reconnect struct {
+	open    func() (Transport, error)
+	timeout time.Duration // reply timeout of the status request checking a reopened port
+	log     *slog.Logger
+
+	mu     sync.Mutex
+	t      Transport // nil while reconnecting
+	next   Transport // reopened, put in use by the next Read
+	n      int       // reconnections made
+	closed chan struct{}
+}
+
+// ReconnectSerial opens the tty with OpenSerial, reopening it with the same options
+// whenever it fails
+//
+// with the provided udev rules the /dev/clario symlink disappears while the adapter is
+// gone, the tty is reopened once it is back.
+func ReconnectSerial(tty string, opts ...Option) (*Reconnect, error) {
+	return NewReconnect(func() (Transport, error) {
+		if _, err := os.Stat(tty); err != nil {
+			return nil, err
+		}
+		return OpenSerial(tty, opts...)
+	}, opts...)
+}
+
+// NewReconnect opens a transport with open, calling it again to replace the transport
+// whenever it fails
+//
+// CmdTimeout bounds the status request checking a reopened transport, reconnections are
+// reported to the Logger.
+func NewReconnect(open func() (Transport, error), opts ...Option) (*Reconnect, error) {
+	t, err := open()
+	if err != nil {
+		return nil, err
+	}
+	o := collect(opts)
+	return &Reconnect{open: open, t: t, timeout: o.cmdTimeout, log: o.log, closed: make(chan struct{})}, nil
+}
+
+// Reconnects returns the number of times the transport has been reopened
+func (r *Reconnect) Reconnects() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.n
+}
+
+// current returns the open transport
+func (r *Reconnect) current() (Transport, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	select {
+	case <-r.closed:
+		return nil, ErrClosed
+	default:
+	}
+	if r.t == nil {
+		return nil, ErrDisconnected
+	}
+	return r.t, nil
+}
+
+// Write writes to the open transport, failing with ErrDisconnected while it is being
+// reopened
+func (r *Reconnect) Write(p []byte) (int, error) {
+	t, err := r.current()
+	if err != nil {
+		return 0, err
+	}
+	n, err := t.Write(p)
+	if err != nil && disconnected(err) {
+		r.drop(t, err)
+		return n, fmt.Errorf("%w: %w", ErrDisconnected, err)
+	}
+	return n, err
+}
+
+// SetWriteDeadline applies to the open transport, if it supports deadlines
+func (r *Reconnect) SetWriteDeadline(d time.Time) error {
+	t, err := r.current()
+	if err != nil {
+		return err
+	}
+	if wd, ok := t.(interface{ SetWriteDeadline(time.Time) error }); ok {
+		return wd.SetWriteDeadline(d)
+	}
+	return nil
+}
+
+// Flush flushes the open transport, if it supports flushing
+func (r *Reconnect) Flush() error {
+	t, err := r.current()
+	if err != nil {
+		return err
+	}
+	if f, ok := t.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// Read reads from the open transport, when it fails Read blocks until it has been
+// reopened and returns ErrReconnected
+func (r *Reconnect) Read(p []byte) (int, error) {
+	// the reopened transport is only used once the reader has seen ErrReconnected, so
+	// nothing written to it can be mistaken for having been in flight
+	r.mu.Lock()
+	if r.next != nil {
+		r.t, r.next = r.next, nil
+		r.n++
+	}
+	r.mu.Unlock()
+
+	t, err := r.current()
+	if errors.Is(err, ErrClosed) {
+		return 0, err
+	}
+	if t != nil {
+		n, err := t.Read(p)
+		switch {
+		case n > 0:
+			return n, nil
+		case err == nil:
+			return 0, nil
+		case !disconnected(err):
+			return 0, err
+		}
+		r.drop(t, err)
+	}
+	return 0, r.reconnect()
+}
+
+// reconnect reopens the transport, returning ErrReconnected once it answers
+func (r *Reconnect) reconnect() error {
+	for {
+		select {
+		case <-r.closed:
+			return ErrClosed
+		case <-time.After(reconnectPoll):
+		}
+		t, err := r.open()
+		if err != nil {
+			r.log.Debug("reopen failed", "err", err)
+			continue
+		}
+		if err := resync(t, r.timeout); err != nil {
+			r.log.Debug("reopened transport not answering", "err", err)
+			t.Close()
+			continue
+		}
+		r.log.Info("transport reopened")
+
+		r.mu.Lock()
+		select {
+		case <-r.closed:
+			r.mu.Unlock()
+			t.Close()
+			return ErrClosed
+		default:
+		}
+		r.next = t
+		r.mu.Unlock()
+		return ErrReconnected
+	}
+}
+
+// drop closes a failed transport
+func (r *Reconnect) drop(t Transport, err error) {
+	r.mu.Lock()
+	if r.t == t {
+		r.t = nil
+		r.log.Warn("transport lost, reopening", "err", err)
+	}
+	r.mu.Unlock()
+	t.Close()
+}
+
+// Close closes the transport and stops reconnecting
+func (r *Reconnect) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	select {
+	case <-r.closed:
+		return nil
+	default:
+	}
+	close(r.closed)
+	if r.next != nil {
+		r.next.Close()
+		r.next = nil
+	}
+	if r.t == nil {
+		return nil
+	}
+	err := r.t.Close()
+	r.t = nil
+	return err
+}
+
+// resync discards anything left on a reopened transport and checks the instrument
+// answers a status request
+func resync(t Transport, timeout time.Duration) error {
+	if f, ok := t.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+	if _, err := t.Write(frame(cmdStatus)); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		resp, err := newFrameReader(t).readFrame()
+		if err == nil && len(resp) != 17 {
+			err = fmt.Errorf("malformed status response. got %d bytes", len(resp))
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		// unblocks the read
+		t.Close()
+		return ErrTimeout
+	}
+}
+
+// disconnected reports whether err means the transport is gone for good
+func disconnected(err error) bool {
+	return errors.Is(err, syscall.EIO) || errors.Is(err, syscall.ENODEV) || errors.Is(err, syscall.ENXIO) ||
+		errors.Is(err, io.EOF) || errors.Is(err, os.ErrClosed) || errors.Is(err, io.ErrClosedPipe)
+}
@@ -0,0 +1,55 @@
+package bmg
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReconnect(t *testing.T) {
+	// each open is a new connection to an instrument answering status requests, the
+	// instrument end is handed over so the test can pull the plug
+	plugs := make(chan net.Conn, 2)
+	r, err := NewReconnect(func() (Transport, error) {
+		cl, te := net.Pipe()
+		go func() {
+			buf := make([]byte, len(frame(cmdStatus)))
+			for {
+				if _, err := io.ReadFull(te, buf); err != nil {
+					return
+				}
+				te.Write(statusResp)
+			}
+		}()
+		plugs <- te
+		return cl, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := New(r)
+	defer c.Close()
+	ctx := context.Background()
+
+	if _, err := c.GetStatus(ctx); err != nil {
+		t.Fatal(err)
+	}
+	(<-plugs).Close()
+	if _, err := c.GetStatus(ctx); !errors.Is(err, ErrDisconnected) {
+		t.Fatalf("unexpected error while disconnected %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for r.Reconnects() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("transport not reopened")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := c.GetStatus(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
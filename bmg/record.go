@@ -0,0 +1,201 @@
+package bmg
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Direction of a recorded frame
+type Direction string
+
+const (
+	Tx Direction = "tx" // host to plate reader
+	Rx Direction = "rx" // plate reader to host
+)
+
+// Record is a single frame captured on the wire
+type Record struct {
+	Time  time.Time `json:"time"`
+	Dir   Direction `json:"dir"`
+	Frame HexBytes  `json:"frame"` // the complete frame, header through CR
+}
+
+// HexBytes marshals as a hex string so recordings stay readable
+type HexBytes []byte
+
+// MarshalText implements encoding.TextMarshaler
+func (h HexBytes) MarshalText() ([]byte, error) {
+	return []byte(hex.EncodeToString(h)), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler
+func (h *HexBytes) UnmarshalText(b []byte) error {
+	d, err := hex.DecodeString(string(b))
+	if err != nil {
+		return err
+	}
+	*h = d
+	return nil
+}
+
+// Recorder writes every frame exchanged with the plate reader as JSON lines
+type Recorder struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+	err error
+}
+
+// NewRecorder returns a Recorder writing to w, attach it with Clario.Record
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{enc: json.NewEncoder(w)}
+}
+
+// Err returns the first error encountered writing the recording
+func (r *Recorder) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+// record appends a frame, errors are kept for Err rather than failing the exchange
+func (r *Recorder) record(dir Direction, frame []byte) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return
+	}
+	r.err = r.enc.Encode(Record{Time: time.Now(), Dir: dir, Frame: frame})
+}
+
+// Record tees every frame written to and read from the plate reader into r, a nil
+// Recorder stops recording
+func (c *Clario) Record(r *Recorder) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rec = r
+}
+
+// recorder returns the attached Recorder, if any
+func (c *Clario) recorder() *Recorder {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rec
+}
+
+// ReadRecording loads a session written by a Recorder
+func ReadRecording(r io.Reader) ([]Record, error) {
+	var recs []Record
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 1<<20)
+	for n := 1; sc.Scan(); n++ {
+		if len(bytes.TrimSpace(sc.Bytes())) == 0 {
+			continue
+		}
+		var rec Record
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("error parsing record on line %d: %w", n, err)
+		}
+		if rec.Dir != Tx && rec.Dir != Rx {
+			return nil, fmt.Errorf("unknown direction %q on line %d", rec.Dir, n)
+		}
+		recs = append(recs, rec)
+	}
+	return recs, sc.Err()
+}
+
+// the command written doesn't match the next command in the recording
+var ErrReplayMismatch = errors.New("command does not match recording")
+
+// Replay is a Transport serving a recorded session back
+//
+// each frame written must match the next recorded command, the responses recorded
+// after it are then made available to read. Replies are served immediately, so a
+// recorded run re-executes deterministically without the instrument.
+type Replay struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	recs   []Record
+	next   int    // index of the next record to replay
+	buf    []byte // responses waiting to be read
+	closed bool
+}
+
+// NewReplay returns a Replay of recs, as loaded by ReadRecording
+func NewReplay(recs []Record) *Replay {
+	r := &Replay{recs: recs}
+	r.cond = sync.NewCond(&r.mu)
+	return r
+}
+
+// Write checks p against the next recorded command and queues the recorded responses
+func (r *Replay) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return 0, ErrClosed
+	}
+
+	// responses recorded without a preceding command (e.g. late frames) are served
+	// ahead of the next command
+	r.queueRx()
+	if r.next >= len(r.recs) {
+		return 0, fmt.Errorf("%w: recording exhausted", ErrReplayMismatch)
+	}
+	rec := r.recs[r.next]
+	if !bytes.Equal(p, rec.Frame) {
+		return 0, fmt.Errorf("%w: record %d: wrote % x, recorded % x", ErrReplayMismatch, r.next, p, []byte(rec.Frame))
+	}
+	r.next++
+	r.queueRx()
+	r.cond.Broadcast()
+	return len(p), nil
+}
+
+// queueRx moves the responses up to the next command into the read buffer
+func (r *Replay) queueRx() {
+	for r.next < len(r.recs) && r.recs[r.next].Dir == Rx {
+		r.buf = append(r.buf, r.recs[r.next].Frame...)
+		r.next++
+	}
+}
+
+// Read blocks until recorded responses are available
+func (r *Replay) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for len(r.buf) == 0 && !r.closed {
+		r.cond.Wait()
+	}
+	if len(r.buf) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// Close unblocks readers
+func (r *Replay) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	r.cond.Broadcast()
+	return nil
+}
+
+// Remaining returns the number of records not yet replayed
+func (r *Replay) Remaining() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.recs) - r.next
+}
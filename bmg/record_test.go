@@ -0,0 +1,58 @@
+package bmg
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"slices"
+	"testing"
+)
+
+func TestRecordReplay(t *testing.T) {
+	cl, te := net.Pipe()
+	go func() {
+		buf := make([]byte, len(frame(cmdStatus)))
+		for {
+			if _, err := io.ReadFull(te, buf); err != nil {
+				return
+			}
+			te.Write(statusResp)
+		}
+	}()
+
+	var rec bytes.Buffer
+	c := New(cl)
+	c.Record(NewRecorder(&rec))
+	ctx := context.Background()
+	want, err := c.GetStatus(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	recs, err := ReadRecording(&rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 2 || recs[0].Dir != Tx || recs[1].Dir != Rx || !slices.Equal(recs[1].Frame, statusResp) {
+		t.Fatalf("unexpected recording %+v", recs)
+	}
+
+	r := NewReplay(recs)
+	c = New(r)
+	defer c.Close()
+	got, err := c.GetStatus(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(got.Flags, want.Flags) || r.Remaining() != 0 {
+		t.Fatalf("replay diverged: %v, %d records left", got.Flags, r.Remaining())
+	}
+
+	// the recording is exhausted
+	if _, err := c.write(ctx, cmdStatus); !errors.Is(err, ErrReplayMismatch) {
+		t.Fatalf("expected replay mismatch, got %v", err)
+	}
+}
@@ -62,11 +62,32 @@ func (p *PlateCfg) SetWells(idx ...int) error {
 		return fmt.Errorf("row and column count must be set")
 	}
 	for _, v := range idx {
-		p.Wells[v/p.Rows] |= (1 << (7 - v%8))
+		if v < 0 || v >= p.Rows*p.Cols || v >= 8*len(p.Wells) {
+			return fmt.Errorf("well %d is not on the plate", v)
+		}
+	}
+	for _, v := range idx {
+		p.Wells[v/8] |= (1 << (7 - v%8))
 	}
 	return nil
 }
 
+// selected returns the row major index of each well read, in the order their values
+// are returned. All wells of the plate are read if none were set.
+func (p PlateCfg) selected() []int {
+	var idx, all []int
+	for i := 0; i < p.Cols*p.Rows && i < 384; i++ {
+		if p.Wells[i/8]&(1<<(7-i%8)) != 0 {
+			idx = append(idx, i)
+		}
+		all = append(all, i)
+	}
+	if idx == nil {
+		return all
+	}
+	return idx
+}
+
 // plateBytes serializes the plate configuration
 func plateBytes(pl PlateCfg) ([]byte, error) {
 	switch {
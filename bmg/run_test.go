@@ -16,4 +16,14 @@ func TestSetWells(t *testing.T) {
 		t.Fatal("incorrect well encoding")
 	}
 
+	// the bit field is the same whatever the plate's row count
+	pl := PlateCfg{Rows: 16, Cols: 24}
+	pl.SetWells(20, 383)
+	if pl.Wells[2] != 0x08 || pl.Wells[47] != 0x01 || !slices.Equal(pl.selected(), []int{20, 383}) {
+		t.Fatalf("incorrect 384 well encoding % x", pl.Wells)
+	}
+	if err := pl.SetWells(384); err == nil {
+		t.Fatal("well off the plate accepted")
+	}
+
 }
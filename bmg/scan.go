@@ -0,0 +1,201 @@
+package bmg
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// ScanType selects the monochromator stepped through a fluorescence spectral scan
+type ScanType uint8
+
+const (
+	ScanEx ScanType = iota + 1 // excitation scan at a fixed emission
+	ScanEm                     // emission scan at a fixed excitation
+)
+
+// largest number of points in a spectral scan, the monochromators cover roughly
+// 320-850nm so anything beyond 1nm steps across it is implausible
+const maxScanPoints = 1000
+
+// most fluorescence values a single data block can hold, the frame size is a uint16
+// covering the 7 framing bytes, the 34 byte header and the trailing 0x00
+const maxBlockVals = (0xffff - 7 - 34 - 1) / 4
+
+// FlScan configures a fluorescence spectral scan, stepping one monochromator from Start
+// to Stop while the other is held at its fixed wavelength
+//
+// Experimental: needs the Experimental option, see flScanBytes.
+type FlScan struct {
+	Scan  ScanType `json:"scan"`
+	Start int      `json:"start"` // first wavelength of the scan (nm)
+	Stop  int      `json:"stop"`  // last wavelength of the scan (nm), must be on a step
+	Step  int      `json:"step"`  // step between points (nm)
+
+	Ex   int `json:"ex"`    // fixed excitation center wavelength, unused in an excitation scan
+	ExBw int `json:"ex_bw"` // excitation bandwidth
+	Dich int `json:"dich"`  // dichroic wavelength * 10
+	Em   int `json:"em"`    // fixed emission center wavelength, unused in an emission scan
+	EmBw int `json:"em_bw"` // emission bandwidth
+	Gain int `json:"gain"`  // gain
+
+	FocalHeight  int  `json:"focal_height"`  // focal height (mm) * 100
+	Flashes      int  `json:"flashes"`       // number of flashes per point 0-200
+	BottomOptic  bool `json:"bottom_optic"`  // use bottom optic, defaults to top optic
+	SettlingTime int  `json:"settling_time"` // 0-10 deciseconds
+}
+
+// Wavelengths returns the wavelengths measured by the scan, in order
+func (s FlScan) Wavelengths() []int {
+	if s.Step <= 0 {
+		return nil
+	}
+	var wl []int
+	for w := s.Start; w <= s.Stop; w += s.Step {
+		wl = append(wl, w)
+	}
+	return wl
+}
+
+// FlSpectrum holds the result of a fluorescence spectral scan
+type FlSpectrum struct {
+	Total       int        `json:"total"`                // total number of values the run will produce
+	Complete    int        `json:"complete"`             // number of completed measurements
+	Wells       int        `json:"wells"`                // number of wells measured
+	Temp        float32    `json:"temp"`                 // the temperature of the incubator if enabled
+	Ovf         uint32     `json:"ovf"`                  // overflow value
+	Wavelengths []int      `json:"wavelengths"`          // wavelength of each point of the spectra (nm)
+	Vals        [][]uint32 `json:"vals"`                 // spectra, [well][point] wells are row major order
+	Instrument  *Identity  `json:"instrument,omitempty"` // the instrument measuring, if identified
+}
+
+// RunFlScan runs a fluorescence spectral scan, blocking until the spectra are read or
+// ctx is done
+//
+// a scan produces far more values than an endpoint read. Retrieving data split across
+// several blocks is not implemented, no capture of such a read exists: scans of more
+// values than a frame can carry are refused up front and one the instrument splits
+// anyway fails with ErrMultiBlock after measuring. If the run is stopped by Abort the
+// points measured so far are returned with ErrAborted.
+//
+// Experimental: fails with ErrExperimental unless the Experimental option is set.
+func (c *Clario) RunFlScan(ctx context.Context, rc RunCfg, s FlScan) (FlSpectrum, error) {
+	cmd, err := flScanBytes(rc, s)
+	if err != nil {
+		return FlSpectrum{}, err
+	}
+	if err := c.allow("fluorescence spectral scan"); err != nil {
+		return FlSpectrum{}, err
+	}
+	c.checkModule(ModuleFluorescence)
+	end, err := c.begin("fluorescence scan")
+	if err != nil {
+		return FlSpectrum{}, err
+	}
+	defer end()
+
+	if err := c.prepare(ctx); err != nil {
+		return FlSpectrum{}, err
+	}
+	merr := c.measure(ctx, cmd)
+	switch {
+	case errors.Is(merr, ErrAborted):
+		st, err := c.GetStatus(ctx)
+		if err != nil || !slices.Contains(st.Flags, FlagUnreadData) {
+			return FlSpectrum{}, merr
+		}
+	case merr != nil:
+		return FlSpectrum{}, merr
+	}
+	resp, err := c.readData(ctx)
+	if err != nil {
+		return FlSpectrum{}, err
+	}
+	r, err := unmarshalFlSpectrum(resp, s.Wavelengths())
+	if err != nil {
+		return FlSpectrum{}, err
+	}
+	r.Instrument = c.identity()
+	return r, merr
+}
+
+// chromat returns the multichromat the scan starts at
+func (s FlScan) chromat() FlChromat {
+	ch := FlChromat{Ex: s.Ex, ExBw: s.ExBw, Dich: s.Dich, Em: s.Em, EmBw: s.EmBw, Gain: s.Gain}
+	if s.Scan == ScanEx {
+		ch.Ex = s.Start
+	} else {
+		ch.Em = s.Start
+	}
+	return ch
+}
+
+// flScanBytes serializes the scan as an endpoint read of its first point, with the
+// scan block in place of the zeros following the multichromat count:
+//
+//	0   scan type
+//	1-2 stop wavelength * 10
+//	3-4 step * 10
+//
+// only the cleared discrete bit comes from a capture (of an absorbance spectrum), the
+// block is modelled on the absorbance start/stop/step fields and its placement and the
+// scan type values are guesses.
+func flScanBytes(rc RunCfg, s FlScan) ([]byte, error) {
+	switch {
+	case s.Scan != ScanEx && s.Scan != ScanEm:
+		return nil, fmt.Errorf("invalid scan type %d", s.Scan)
+	case s.Step <= 0 || s.Start >= s.Stop:
+		return nil, fmt.Errorf("scan must step up from start to stop")
+	case (s.Stop-s.Start)%s.Step != 0:
+		return nil, fmt.Errorf("scan stop %d is not on a %dnm step from %d", s.Stop, s.Step, s.Start)
+	case len(s.Wavelengths()) > maxScanPoints:
+		return nil, fmt.Errorf("too many points in scan (must be at most %d)", maxScanPoints)
+	case len(s.Wavelengths())*len(rc.Plate.selected()) > maxBlockVals:
+		return nil, fmt.Errorf("scan of %d points over %d wells exceeds the %d values of a data block",
+			len(s.Wavelengths()), len(rc.Plate.selected()), maxBlockVals)
+	case s.Scan == ScanEx && s.Stop+s.ExBw/2 >= s.Em-s.EmBw/2:
+		return nil, fmt.Errorf("excitation scan overlaps the emission band")
+	case s.Scan == ScanEm && s.Start-s.EmBw/2 <= s.Ex+s.ExBw/2:
+		return nil, fmt.Errorf("emission scan overlaps the excitation band")
+	case rc.Plate.FlyingMode:
+		return nil, fmt.Errorf("flying mode not valid for spectral scans")
+	}
+
+	scan := []byte{byte(s.Scan)}
+	scan = binary.BigEndian.AppendUint16(scan, uint16(s.Stop*10))
+	scan = binary.BigEndian.AppendUint16(scan, uint16(s.Step*10))
+
+	fl := FlCfg{
+		Chromats:     []FlChromat{s.chromat()},
+		FocalHeight:  s.FocalHeight,
+		Flashes:      s.Flashes,
+		BottomOptic:  s.BottomOptic,
+		SettlingTime: s.SettlingTime,
+	}
+	return flCmd(rc, fl, scan)
+}
+
+// unmarshalFlSpectrum decodes the response of a scan measuring wl
+//
+// that the response shares the endpoint schema, with a point per multichromat and the
+// values wavelength major, is assumed rather than seen.
+func unmarshalFlSpectrum(resp []byte, wl []int) (FlSpectrum, error) {
+	d, err := unmarshalFl(resp, maxScanPoints)
+	if err != nil {
+		return FlSpectrum{}, err
+	}
+	if d.Multichromats != len(wl) {
+		return FlSpectrum{}, fmt.Errorf("malformed data response, %d points for a %d point scan", d.Multichromats, len(wl))
+	}
+	return FlSpectrum{
+		Total:       d.Total,
+		Complete:    d.Complete,
+		Wells:       d.Wells,
+		Temp:        d.Temp,
+		Ovf:         d.Ovf,
+		Wavelengths: wl,
+		Vals:        d.Vals,
+	}, nil
+}
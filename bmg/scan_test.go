@@ -0,0 +1,82 @@
+package bmg
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestFlScan(t *testing.T) {
+	pl := PlateCfg{
+		Length:      12776,
+		Width:       8548,
+		CornerX:     1438,
+		CornerY:     1124,
+		Cols:        12,
+		Rows:        8,
+		StartCorner: TopLeft,
+	}
+	pl.SetWells(0, 1)
+	rc := RunCfg{Plate: pl}
+	s := FlScan{Scan: ScanEm, Start: 510, Stop: 600, Step: 5, Ex: 470, ExBw: 16, Dich: 4950, EmBw: 16, Gain: 1200, FocalHeight: 40, Flashes: 20}
+
+	if wl := s.Wavelengths(); len(wl) != 19 || wl[0] != 510 || wl[18] != 600 {
+		t.Fatalf("unexpected wavelengths %v", wl)
+	}
+
+	cmd, err := flScanBytes(rc, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cmd[63]&(1<<1) != 0 {
+		t.Fatal("discrete bit set in spectrum")
+	}
+	r, err := DecodeRun(frame(cmd))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Fl != nil || r.FlScan == nil || *r.FlScan != s || len(r.Unknown) != 0 {
+		t.Fatalf("decoded scan differs: %+v %+v", r.FlScan, r.Unknown)
+	}
+
+	// an endpoint read of the same chromat differs only in the discrete bit and scan block
+	ep, err := flBytes(rc, FlCfg{Chromats: []FlChromat{s.chromat()}, FocalHeight: 40, Flashes: 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var diff []int
+	for i := range ep {
+		if ep[i] != cmd[i] {
+			diff = append(diff, i)
+		}
+	}
+	if !slices.Equal(diff, []int{63, 82, 83, 84, 86}) {
+		t.Fatalf("unexpected differences from endpoint at %v", diff)
+	}
+
+	for _, bad := range []FlScan{
+		{Scan: ScanEm, Start: 600, Stop: 510, Step: 5, Ex: 470},
+		{Scan: ScanEm, Start: 510, Stop: 600, Step: 0, Ex: 470},
+		{Scan: ScanEm, Start: 480, Stop: 600, Step: 5, Ex: 470, ExBw: 16, EmBw: 16},
+		{Scan: ScanEx, Start: 400, Stop: 520, Step: 5, Em: 520},
+		{Start: 510, Stop: 600, Step: 5},
+		{Scan: ScanEm, Start: 510, Stop: 602, Step: 5, Ex: 470, ExBw: 16, EmBw: 16},
+	} {
+		if _, err := flScanBytes(rc, bad); err == nil {
+			t.Fatalf("invalid scan accepted %+v", bad)
+		}
+	}
+
+	// 96 wells of 200 points can't come back in one block
+	all := rc
+	all.Plate.Wells = WellCfg{}
+	long := s
+	long.Start, long.Stop, long.Step = 400, 599, 1
+	long.Ex, long.Em = 350, 0
+	if _, err := flScanBytes(all, long); err == nil {
+		t.Fatal("scan exceeding a data block accepted")
+	}
+	all.Plate.SetWells(0)
+	if _, err := flScanBytes(all, long); err != nil {
+		t.Fatal(err)
+	}
+}
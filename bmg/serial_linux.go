@@ -3,6 +3,7 @@
 package bmg
 
 import (
+	"errors"
 	"fmt"
 	"os"
 
@@ -15,17 +16,72 @@ import (
 // but make the termios IOCTLs....
 // need ftdi_sio module to get serial interface to plate reader. The custom dev ID must be added.
 
-// openPort returns an *os.File
-func openPort(tty string) (*os.File, error) {
+// serialPort is the tty of the plate reader
+type serialPort struct {
+	*os.File
+	lock string // lock file naming this process as the holder
+}
+
+// Close releases the tty for other processes and closes it
+func (p *serialPort) Close() error {
+	if p.lock != "" {
+		os.Remove(p.lock)
+	}
+	p.ioctl(unix.TIOCNXCL, 0)
+	return p.File.Close()
+}
+
+// Flush discards data received and not read, and data written but not transmitted
+func (p *serialPort) Flush() error {
+	return p.ioctl(unix.TCFLSH, unix.TCIOFLUSH)
+}
+
+// ioctl applies an ioctl to the tty without Fd, which would switch it to blocking mode
+func (p *serialPort) ioctl(req uint, arg int) error {
+	rc, err := p.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var ierr error
+	if err := rc.Control(func(fd uintptr) { ierr = unix.IoctlSetInt(int(fd), req, arg) }); err != nil {
+		return err
+	}
+	return ierr
+}
+
+// openPort opens the tty, takes exclusive use of it and applies the serial configuration
+//
+// ErrInstrumentBusy is returned if another process holds the tty
+func openPort(tty string, cfg serialCfg) (*serialPort, error) {
 	fd, err := unix.Open(tty, unix.O_RDWR|unix.O_NOCTTY, 0)
+	if errors.Is(err, unix.EBUSY) {
+		// refused by TIOCEXCL
+		return nil, busyError(tty)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("error opening file: %w", err)
 	}
 
+	// the advisory lock is what cooperating processes check, TIOCEXCL additionally makes
+	// any other (non root) open fail while it is held
+	if err := unix.Flock(fd, unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		unix.Close(fd)
+		if errors.Is(err, unix.EWOULDBLOCK) {
+			return nil, busyError(tty)
+		}
+		return nil, fmt.Errorf("error locking %s: %w", tty, err)
+	}
+	unix.IoctlSetInt(fd, unix.TIOCEXCL, 0)
+	lock := lockPath(tty)
+	if err := writeLock(lock); err != nil {
+		// nothing but the holder report depends on it
+		lock = ""
+	}
+
 	// termios2 is the only version that actually supports I/O speed, otherwise its a CFLAG and I/O speed is lost
 	t, err := unix.IoctlGetTermios(fd, unix.TCGETS2)
 	if err != nil {
-		fmt.Println(err)
+		release(fd, lock)
 		return nil, fmt.Errorf("error getting termios2: %w", err)
 	}
 
@@ -62,25 +118,40 @@ func openPort(tty string) (*os.File, error) {
 	t.Cflag &^= uint32(unix.CSIZE | unix.PARENB | unix.CBAUD)
 	t.Cflag |= unix.CS8 | unix.CREAD | unix.CLOCAL | unix.BOTHER
 
-	t.Ispeed = 125000
-	t.Ospeed = 125000
+	t.Ispeed = uint32(cfg.baud)
+	t.Ospeed = uint32(cfg.baud)
 
 	// Terminal special characters array
 	// VMIN - Minimum number of characters for noncanonical read
 	// VTIME - Timeout in deciseconds for noncanonical read
+	// both are ignored once the tty is non-blocking below, reads return what is buffered
 	t.Cc[unix.VMIN] = 1
 	t.Cc[unix.VTIME] = 10
 
 	err = unix.IoctlSetTermios(fd, unix.TCSETS2, t)
 	if err != nil {
-		fmt.Println(err)
+		release(fd, lock)
 		return nil, fmt.Errorf("error setting termios2: %w", err)
 	}
 
 	// discard data received and not read, and data written but not transmitted
 	unix.IoctlSetInt(fd, unix.TCFLSH, unix.TCIOFLUSH)
 
+	// non-blocking so the runtime poller can interrupt the reader goroutine on Close
+	if err := unix.SetNonblock(fd, true); err != nil {
+		release(fd, lock)
+		return nil, fmt.Errorf("error setting non-blocking: %w", err)
+	}
 	f := os.NewFile(uintptr(fd), "bmg")
 
-	return f, nil
+	return &serialPort{File: f, lock: lock}, nil
+}
+
+// release gives up a tty that failed to open
+func release(fd int, lock string) {
+	if lock != "" {
+		os.Remove(lock)
+	}
+	unix.IoctlSetInt(fd, unix.TIOCNXCL, 0)
+	unix.Close(fd)
 }
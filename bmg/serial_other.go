@@ -0,0 +1,18 @@
+//go:build !linux
+
+package bmg
+
+import (
+	"errors"
+	"os"
+)
+
+// serialPort is the tty of the plate reader
+type serialPort struct {
+	*os.File
+}
+
+// openPort is only implemented for linux (termios2 is required for the 125000 baud rate)
+func openPort(tty string, cfg serialCfg) (*serialPort, error) {
+	return nil, errors.New("serial ports are only supported on linux, use another Transport")
+}
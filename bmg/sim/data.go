@@ -0,0 +1,146 @@
+package sim
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+
+	"github.com/hoxbio/bmg-clariostar/bmg"
+)
+
+// data response schemas
+const (
+	schemaFl  = 0x21
+	schemaAbs = 0x29
+)
+
+// run holds the parts of a run command needed to synthesize its data
+type run struct {
+	schema   byte
+	wells    int          // number of wells measured
+	chromats int          // multichromats or scan points (fl) or wavelengths (abs) per well
+	modules  []bmg.Module // modules the run measures with
+}
+
+// parseRun pulls the plate and modality out of a run command
+func parseRun(cmd []byte) (run, error) {
+	d, err := bmg.DecodeRun(cmd)
+	if err != nil {
+		return run{}, err
+	}
+	r := run{}
+
+	// count the wells selected in the plate bit field
+	pl := d.Cfg.Plate
+	for i := 0; i < pl.Cols*pl.Rows && i < 384; i++ {
+		if pl.Wells[i/8]&(1<<(7-i%8)) != 0 {
+			r.wells++
+		}
+	}
+
+	switch {
+	case d.Abs != nil:
+		r.schema = schemaAbs
+		r.chromats = len(d.Abs.Wavelengths)
+		r.modules = []bmg.Module{bmg.ModuleAbsorbance}
+	case d.FlScan != nil:
+		// a point of the spectrum per multichromat
+		r.schema = schemaFl
+		r.chromats = len(d.FlScan.Wavelengths())
+		r.modules = []bmg.Module{bmg.ModuleFluorescence}
+	default:
+		r.schema = schemaFl
+		r.chromats = len(d.Fl.Chromats)
+		r.modules = []bmg.Module{bmg.ModuleFluorescence}
+		for _, ch := range d.Fl.Chromats {
+			if ch.ExFilter || ch.EmFilter {
+				r.modules = append(r.modules, bmg.ModuleFilters)
+				break
+			}
+		}
+		if d.Fl.TRF != nil {
+			r.modules = append(r.modules, bmg.ModuleTRF)
+		}
+	}
+	if r.wells == 0 || r.chromats == 0 {
+		return run{}, fmt.Errorf("empty run")
+	}
+	return r, nil
+}
+
+// payload synthesizes the data response of a completed run
+func (r run) payload() []byte {
+	if r.schema == schemaAbs {
+		return r.absPayload()
+	}
+	return r.flPayload(r.wells * r.chromats)
+}
+
+// partial synthesizes the data response of a run stopped after complete values, nil
+// if nothing can be read back
+func (r run) partial(complete int) []byte {
+	// absorbance needs the reference reads taken at the end of the run
+	if r.schema == schemaAbs || complete == 0 {
+		return nil
+	}
+	return r.flPayload(complete)
+}
+
+// signal is the synthetic raw reading for a well and chromat
+func signal(well, chromat int) uint32 {
+	// cheap deterministic scatter so neighbouring wells differ
+	return 60000 + uint32(bits.RotateLeft32(uint32(well)*2654435761, chromat)%15000)
+}
+
+// flPayload builds a 0x21 response holding the first complete values, in chromat
+// major order
+func (r run) flPayload(complete int) []byte {
+	n := r.wells * r.chromats
+	resp := make([]byte, 34, 34+complete*4+1)
+	copy(resp, []byte{0x02, 0x05, 0x06, 0x26, 0x00, 0x00})
+	resp[6] = schemaFl
+	binary.BigEndian.PutUint16(resp[7:9], uint16(n))
+	binary.BigEndian.PutUint16(resp[9:11], uint16(complete))
+	binary.BigEndian.PutUint32(resp[11:15], 260000)
+	resp[15] = 0x01
+	binary.BigEndian.PutUint16(resp[16:18], uint16(r.chromats))
+	binary.BigEndian.PutUint16(resp[18:20], uint16(r.wells))
+
+	for i := range complete {
+		resp = binary.BigEndian.AppendUint32(resp, signal(i%r.wells, i/r.wells))
+	}
+	return append(resp, 0x00)
+}
+
+// absPayload builds a 0x29 response, raw reads followed by the well, chromat and
+// reference channel references
+func (r run) absPayload() []byte {
+	n := r.wells*r.chromats + r.wells + 2*r.chromats + 2
+	resp := make([]byte, 36, 36+n*4+1)
+	copy(resp, []byte{0x02, 0x05, 0x06, 0x26, 0x00, 0x00})
+	resp[6] = schemaAbs
+	binary.BigEndian.PutUint16(resp[7:9], uint16(n))
+	binary.BigEndian.PutUint16(resp[9:11], uint16(n))
+	binary.BigEndian.PutUint32(resp[11:15], 0x001dffe2)
+	resp[15] = 0x02
+	binary.BigEndian.PutUint16(resp[16:18], uint16(r.chromats))
+	binary.BigEndian.PutUint16(resp[20:22], uint16(r.wells))
+
+	const hi, ref = 9000000, 2600000
+	// raw reads give transmissions of 50-75%
+	for c := 0; c < r.chromats; c++ {
+		for w := 0; w < r.wells; w++ {
+			resp = binary.BigEndian.AppendUint32(resp, hi/2+signal(w, c)*30)
+		}
+	}
+	for range r.wells {
+		resp = binary.BigEndian.AppendUint32(resp, ref)
+	}
+	for range r.chromats {
+		resp = binary.BigEndian.AppendUint32(resp, hi)
+		resp = binary.BigEndian.AppendUint32(resp, 0)
+	}
+	resp = binary.BigEndian.AppendUint32(resp, ref)
+	resp = binary.BigEndian.AppendUint32(resp, 0)
+	return append(resp, 0x00)
+}
@@ -0,0 +1,51 @@
+package sim
+
+import (
+	"encoding/binary"
+	"slices"
+
+	"github.com/hoxbio/bmg-clariostar/bmg"
+)
+
+// installed module bits, as interpreted by the bmg package
+var moduleBits = []bmg.Module{
+	bmg.ModuleAbsorbance,
+	bmg.ModuleFluorescence,
+	bmg.ModuleLuminescence,
+	bmg.ModuleFilters,
+	bmg.ModuleAlphaScreen,
+	bmg.ModuleTRF,
+	bmg.ModuleFP,
+	bmg.ModuleInjectors,
+	bmg.ModuleACU,
+	bmg.ModuleStacker,
+	bmg.ModuleIncubator,
+}
+
+// eeprom builds the reply to the eeprom request, a CLARIOstar Plus
+func (in *Instrument) eeprom() []byte {
+	resp := make([]byte, 24)
+	resp[0] = 0x07
+	binary.BigEndian.PutUint16(resp[6:8], 0x0026)
+	binary.BigEndian.PutUint16(resp[8:10], 2)
+	copy(resp[10:22], in.Serial)
+
+	var bits uint16
+	for i, m := range moduleBits {
+		if slices.Contains(in.Modules, m) {
+			bits |= 1 << i
+		}
+	}
+	binary.BigEndian.PutUint16(resp[22:24], bits)
+	return resp
+}
+
+// firmwareInfo builds the reply to the firmware info request
+func firmwareInfo() []byte {
+	resp := make([]byte, 28)
+	resp[0] = 0x09
+	binary.BigEndian.PutUint16(resp[6:8], 1350)
+	copy(resp[8:20], "Nov 20 2020")
+	copy(resp[20:28], "11:51:21")
+	return resp
+}
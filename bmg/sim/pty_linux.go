@@ -0,0 +1,70 @@
+//go:build linux
+
+package sim
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Pty is a pseudo-terminal served by the simulator
+type Pty struct {
+	Path   string // path of the terminal to hand to bmg.Open
+	master *os.File
+	slave  *os.File
+}
+
+// Pty exposes the simulator on a new pseudo-terminal and serves it in the background
+func (in *Instrument) Pty() (*Pty, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		return nil, fmt.Errorf("error opening ptmx: %w", err)
+	}
+
+	var p *Pty
+	err = func() error {
+		fd := int(master.Fd())
+		if err := unix.IoctlSetPointerInt(fd, unix.TIOCSPTLCK, 0); err != nil {
+			return fmt.Errorf("error unlocking pty: %w", err)
+		}
+		n, err := unix.IoctlGetInt(fd, unix.TIOCGPTN)
+		if err != nil {
+			return fmt.Errorf("error getting pty number: %w", err)
+		}
+		path := fmt.Sprintf("/dev/pts/%d", n)
+
+		// hold the slave open so the master survives clients coming and going
+		slave, err := os.OpenFile(path, os.O_RDWR|unix.O_NOCTTY, 0)
+		if err != nil {
+			return fmt.Errorf("error opening %s: %w", path, err)
+		}
+		t, err := unix.IoctlGetTermios(int(slave.Fd()), unix.TCGETS)
+		if err == nil {
+			t.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.ICRNL | unix.INLCR | unix.PARMRK | unix.INPCK | unix.ISTRIP | unix.IXON
+			t.Oflag = 0
+			t.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.IEXTEN | unix.ISIG
+			err = unix.IoctlSetTermios(int(slave.Fd()), unix.TCSETS, t)
+		}
+		if err != nil {
+			slave.Close()
+			return fmt.Errorf("error setting pty raw: %w", err)
+		}
+		p = &Pty{Path: path, master: master, slave: slave}
+		return nil
+	}()
+	if err != nil {
+		master.Close()
+		return nil, err
+	}
+
+	go in.Serve(master)
+	return p, nil
+}
+
+// Close tears down the pseudo-terminal
+func (p *Pty) Close() error {
+	p.slave.Close()
+	return p.master.Close()
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+
+package sim
+
+import "errors"
+
+// Pty is a pseudo-terminal served by the simulator
+type Pty struct {
+	Path string // path of the terminal to hand to bmg.Open
+}
+
+// Pty is only implemented on linux
+func (in *Instrument) Pty() (*Pty, error) {
+	return nil, errors.New("pseudo-terminals are only supported on linux")
+}
+
+// Close tears down the pseudo-terminal
+func (p *Pty) Close() error {
+	return nil
+}
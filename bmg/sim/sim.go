@@ -0,0 +1,370 @@
+// Package sim is a software CLARIOstar that speaks the framed serial protocol.
+//
+// It is intended for testing code built on the bmg package without reserving the
+// physical reader. The simulator can be driven in-process through Conn, or exposed
+// on a pseudo-terminal (see Pty) so the CLI can be pointed at it.
+package sim
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/hoxbio/bmg-clariostar/bmg"
+)
+
+// error codes reported in status byte 5, as interpreted by the bmg package
+const (
+	errInvalidParameter = 0x01
+	errLidOpen          = 0x03
+	errNoPlate          = 0x04
+	errTrayOpen         = 0x05
+)
+
+// command bytes recognized by the simulator, the first byte of the unframed command
+const (
+	cmdInit   = 0x01
+	cmdTray   = 0x03
+	cmdRun    = 0x04
+	cmdData   = 0x05
+	cmdStop   = 0x0b
+	cmdStatus = 0x80
+)
+
+// Instrument holds the simulated state of a plate reader
+//
+// The timing and identity fields may be changed before the simulator starts serving.
+type Instrument struct {
+	MoveTime time.Duration // time the tray/plate carrier takes to move
+	WellTime time.Duration // time spent measuring each well
+	Serial   string        // serial number reported on identification
+	Modules  []bmg.Module  // installed modules, runs needing others are rejected
+
+	mu        sync.Mutex
+	flags     map[bmg.FlagID]bool
+	plate     bool      // a plate sits on the carrier
+	busyUntil time.Time // BUSY is raised until this time
+	done      func()    // applied to the state once BUSY clears
+	data      []byte    // data payload of the last run
+	run       *run      // the active or last run
+	runStart  time.Time // when the active run started
+	temps     [2]float32
+	errCode   byte // error code of the last rejected command
+	loci      map[bmg.FlagID]bmg.Flag
+}
+
+// New returns an uninitialized simulator with the tray closed and a plate loaded
+func New() *Instrument {
+	in := &Instrument{
+		MoveTime: time.Second,
+		WellTime: 20 * time.Millisecond,
+		Serial:   "430-0001",
+		Modules:  []bmg.Module{bmg.ModuleAbsorbance, bmg.ModuleFluorescence, bmg.ModuleLuminescence},
+		flags:    map[bmg.FlagID]bool{},
+		plate:    true,
+		loci:     map[bmg.FlagID]bmg.Flag{},
+	}
+	for _, f := range bmg.Flags() {
+		in.loci[f.ID] = f
+	}
+	return in
+}
+
+// SetPlate places (or removes) a plate on the carrier, detected after the next tray close
+func (in *Instrument) SetPlate(present bool) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.plate = present
+}
+
+// SetLid opens or closes the instrument lid
+func (in *Instrument) SetLid(open bool) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.flags[bmg.FlagLidOpen] = open
+}
+
+// SetTemps sets the bottom and top incubator temperatures reported in the status, 0 for off
+func (in *Instrument) SetTemps(bottom, top float32) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.temps = [2]float32{bottom, top}
+}
+
+// Flags returns the currently raised status flags
+func (in *Instrument) Flags() []bmg.FlagID {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.settle()
+	var flags []bmg.FlagID
+	for _, f := range bmg.Flags() {
+		if in.flags[f.ID] {
+			flags = append(flags, f.ID)
+		}
+	}
+	return flags
+}
+
+// Conn starts serving on one end of an in-memory pipe and returns the other end
+func (in *Instrument) Conn() bmg.Transport {
+	cl, dev := net.Pipe()
+	go func() {
+		in.Serve(dev)
+		dev.Close()
+	}()
+	return cl
+}
+
+// Serve reads framed commands from rw and writes the framed responses until rw fails
+//
+// bytes preceding a STX and frames failing validation are dropped, as the instrument
+// does not respond to them.
+func (in *Instrument) Serve(rw io.ReadWriter) error {
+	r := bufio.NewReader(rw)
+	for {
+		cmd, err := readCmd(r)
+		switch {
+		case errors.Is(err, errBadFrame):
+			continue
+		case err != nil:
+			return err
+		}
+		if len(cmd) == 0 {
+			continue
+		}
+		if _, err := rw.Write(frame(in.handle(cmd))); err != nil {
+			return err
+		}
+	}
+}
+
+// handle applies cmd to the instrument and returns the unframed response
+func (in *Instrument) handle(cmd []byte) []byte {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.settle()
+
+	// commands other than status and data retrieval are ignored while busy
+	busy := in.flags[bmg.FlagBusy]
+
+	switch cmd[0] {
+	case cmdInit:
+		if busy {
+			break
+		}
+		in.errCode = 0
+		in.flags[bmg.FlagOpen] = false
+		in.busy(in.MoveTime, func() {
+			in.flags[bmg.FlagInitialized] = true
+			in.detect()
+		})
+	case cmdTray:
+		if busy || len(cmd) < 2 {
+			break
+		}
+		in.errCode = 0
+		if cmd[1] == 0x01 {
+			in.flags[bmg.FlagPlateDetected] = false
+			in.flags[bmg.FlagZProbed] = false
+			in.busy(in.MoveTime, func() { in.flags[bmg.FlagOpen] = true })
+		} else {
+			in.busy(in.MoveTime, func() {
+				in.flags[bmg.FlagOpen] = false
+				in.detect()
+			})
+		}
+	case cmdRun:
+		if busy {
+			break
+		}
+		run, err := parseRun(cmd)
+		switch {
+		case err != nil, !in.installed(run.modules):
+			in.errCode = errInvalidParameter
+		case in.flags[bmg.FlagLidOpen]:
+			in.errCode = errLidOpen
+		case in.flags[bmg.FlagOpen]:
+			in.errCode = errTrayOpen
+		case !in.flags[bmg.FlagPlateDetected]:
+			in.errCode = errNoPlate
+		default:
+			in.errCode = 0
+		}
+		if in.errCode != 0 {
+			break
+		}
+		in.flags[bmg.FlagRunning] = true
+		in.flags[bmg.FlagActive] = true
+		in.flags[bmg.FlagUnreadData] = false
+		in.run = &run
+		in.runStart = time.Now()
+		in.busy(in.WellTime*time.Duration(run.wells), func() {
+			in.flags[bmg.FlagRunning] = false
+			in.flags[bmg.FlagActive] = false
+			in.flags[bmg.FlagUnreadData] = true
+			in.data = run.payload()
+		})
+	case cmdData:
+		switch {
+		case len(cmd) < 2:
+		case cmd[1] == 0x02 && in.data != nil:
+			in.flags[bmg.FlagUnreadData] = false
+			return in.data
+		case cmd[1] == 0x07:
+			return in.eeprom()
+		case cmd[1] == 0x09:
+			return firmwareInfo()
+		}
+	case cmdStop:
+		// abandon the measurement in progress, the tray and carrier stop where they are
+		if in.flags[bmg.FlagRunning] {
+			complete := in.complete()
+			in.flags[bmg.FlagBusy] = false
+			in.flags[bmg.FlagRunning] = false
+			in.flags[bmg.FlagActive] = false
+			in.done = nil
+			// whole wells measured before stopping stay readable
+			if data := in.run.partial(complete); data != nil {
+				in.data = data
+				in.flags[bmg.FlagUnreadData] = true
+			}
+		}
+	case cmdStatus:
+	}
+	return in.status()
+}
+
+// busy raises BUSY for d and schedules fn once it clears
+func (in *Instrument) busy(d time.Duration, fn func()) {
+	in.flags[bmg.FlagBusy] = true
+	in.busyUntil = time.Now().Add(d)
+	in.done = fn
+}
+
+// settle completes the pending action once its busy period has passed
+func (in *Instrument) settle() {
+	if !in.flags[bmg.FlagBusy] || time.Now().Before(in.busyUntil) {
+		return
+	}
+	in.flags[bmg.FlagBusy] = false
+	if in.done != nil {
+		in.done()
+		in.done = nil
+	}
+}
+
+// complete returns the number of values measured in the active or last run
+func (in *Instrument) complete() int {
+	r := in.run
+	total := r.wells * r.chromats
+	if in.flags[bmg.FlagRunning] && in.WellTime > 0 {
+		return min(total, int(time.Since(in.runStart)/in.WellTime)*r.chromats)
+	}
+	return total
+}
+
+// detect probes the carrier for a plate, as done after closing and initializing
+func (in *Instrument) detect() {
+	in.flags[bmg.FlagPlateDetected] = in.plate
+	in.flags[bmg.FlagZProbed] = in.plate
+}
+
+// status encodes the 17 byte status response
+func (in *Instrument) status() []byte {
+	resp := make([]byte, 17)
+	resp[0] = 0x01
+	for id, raised := range in.flags {
+		if raised {
+			f := in.loci[id]
+			resp[f.Byte] |= f.Mask
+		}
+	}
+	resp[1] |= 0x01 // VALID
+	resp[5] = in.errCode
+	resp[6] = 0x03
+	if r := in.run; r != nil {
+		resp[6] = r.schema
+		binary.BigEndian.PutUint16(resp[7:9], uint16(r.wells*r.chromats))
+		binary.BigEndian.PutUint16(resp[9:11], uint16(in.complete()))
+	}
+	binary.BigEndian.PutUint16(resp[11:13], uint16(in.temps[0]*10))
+	binary.BigEndian.PutUint16(resp[13:15], uint16(in.temps[1]*10))
+	resp[15] = 0xc0
+	return resp
+}
+
+// errBadFrame is returned by readCmd for frames failing validation
+var errBadFrame = errors.New("bad frame")
+
+// readCmd reads the next frame from r and returns the unframed command
+//
+// STX | uint16 (size) | NP | data | uint16 (CS) | CR
+func readCmd(r *bufio.Reader) ([]byte, error) {
+	// scan for STX
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if b == 0x02 {
+			break
+		}
+	}
+	header := []byte{0x02, 0x00, 0x00, 0x00}
+	if _, err := io.ReadFull(r, header[1:]); err != nil {
+		return nil, err
+	}
+	size := int(binary.BigEndian.Uint16(header[1:3]))
+	if header[3] != 0x0c || size < 7 {
+		return nil, errBadFrame
+	}
+
+	rest := make([]byte, size-4)
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return nil, err
+	}
+
+	var sum uint16
+	for _, b := range header {
+		sum += uint16(b)
+	}
+	for _, b := range rest[:len(rest)-3] {
+		sum += uint16(b)
+	}
+	if binary.BigEndian.Uint16(rest[len(rest)-3:]) != sum || rest[len(rest)-1] != 0x0d {
+		return nil, errBadFrame
+	}
+	return rest[:len(rest)-3], nil
+}
+
+// frame wraps a response payload the way the instrument does
+func frame(data []byte) []byte {
+	buf := make([]byte, len(data)+7)
+	buf[0] = 0x02
+	binary.BigEndian.PutUint16(buf[1:], uint16(len(data)+7))
+	buf[3] = 0x0c
+	copy(buf[4:], data)
+
+	var sum uint16
+	for _, b := range buf[:len(buf)-3] {
+		sum += uint16(b)
+	}
+	binary.BigEndian.PutUint16(buf[len(buf)-3:], sum)
+	buf[len(buf)-1] = 0x0d
+	return buf
+}
+
+// installed reports whether all of modules are installed
+func (in *Instrument) installed(modules []bmg.Module) bool {
+	for _, m := range modules {
+		if !slices.Contains(in.Modules, m) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,656 @@
+package sim
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"math"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hoxbio/bmg-clariostar/bmg"
+)
+
+func newTestSim() *Instrument {
+	in := New()
+	in.MoveTime = 10 * time.Millisecond
+	in.WellTime = time.Millisecond
+	return in
+}
+
+var testFl = bmg.FlCfg{
+	Chromats:    []bmg.FlChromat{{Ex: 483, ExBw: 14, Dich: 5025, Em: 530, EmBw: 30, Gain: 3000}},
+	FocalHeight: 40,
+	Flashes:     50,
+}
+
+var testPlate = bmg.PlateCfg{
+	Length:      12776,
+	Width:       8548,
+	CornerX:     1438,
+	CornerY:     1124,
+	WellDia:     700,
+	Cols:        12,
+	Rows:        8,
+	StartCorner: bmg.TopLeft,
+}
+
+func TestTray(t *testing.T) {
+	in := newTestSim()
+	c := bmg.New(in.Conn())
+	defer c.Close()
+	ctx := context.Background()
+
+	if err := c.OpenTray(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if f := in.Flags(); !slices.Contains(f, bmg.FlagOpen) || slices.Contains(f, bmg.FlagPlateDetected) {
+		t.Fatalf("unexpected flags after open %v", f)
+	}
+	if err := c.CloseTray(ctx); err != nil {
+		t.Fatal(err)
+	}
+	s, err := c.GetStatus(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if slices.Contains(s.Flags, bmg.FlagOpen) || !slices.Contains(s.Flags, bmg.FlagPlateDetected) {
+		t.Fatalf("unexpected flags after close %v", s.Flags)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	in := newTestSim()
+	c := bmg.New(in.Conn())
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	evs := c.Watch(ctx, 5*time.Millisecond)
+	go c.OpenTray(ctx)
+
+	for e := range evs {
+		if e.Type == bmg.EventTrayOpened {
+			return
+		}
+	}
+	t.Fatal("tray opened event not delivered")
+}
+
+func TestRunFl(t *testing.T) {
+	in := newTestSim()
+	c := bmg.New(in.Conn())
+	defer c.Close()
+	ctx := context.Background()
+
+	fl := testFl
+	d, err := c.RunFl(ctx, bmg.RunCfg{Plate: testPlate}, fl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Wells != 96 || d.Multichromats != 1 || len(d.Vals) != 96 {
+		t.Fatalf("unexpected data shape: %d wells, %d chromats, %d values", d.Wells, d.Multichromats, len(d.Vals))
+	}
+	if slices.Contains(in.Flags(), bmg.FlagUnreadData) {
+		t.Fatal("unread data flag not cleared by data retrieval")
+	}
+}
+
+// GFP and mCherry read in one pass come back per well
+func TestRunFlMultichromat(t *testing.T) {
+	in := newTestSim()
+	c := bmg.New(in.Conn(), bmg.Experimental())
+	defer c.Close()
+
+	pl := testPlate
+	pl.SetWells(0, 1, 2, 3, 4, 5, 6, 7)
+	fl := testFl
+	fl.Chromats = []bmg.FlChromat{
+		{Ex: 470, ExBw: 15, Dich: 4975, Em: 515, EmBw: 20, Gain: 1500},
+		{Ex: 570, ExBw: 15, Dich: 5950, Em: 620, EmBw: 20, Gain: 2000},
+	}
+	gated := bmg.New(in.Conn())
+	_, err := gated.RunFl(context.Background(), bmg.RunCfg{Plate: pl}, fl)
+	gated.Close()
+	if !errors.Is(err, bmg.ErrExperimental) {
+		t.Fatalf("multichromat run sent without the Experimental option: %v", err)
+	}
+
+	d, err := c.RunFl(context.Background(), bmg.RunCfg{Plate: pl}, fl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Wells != 8 || d.Multichromats != 2 || len(d.Vals) != 8 {
+		t.Fatalf("unexpected data shape: %d wells, %d chromats, %d values", d.Wells, d.Multichromats, len(d.Vals))
+	}
+	for w, v := range d.Vals {
+		if len(v) != 2 || v[0] != signal(w, 0) || v[1] != signal(w, 1) {
+			t.Fatalf("unexpected values for well %d: %v", w, v)
+		}
+	}
+}
+
+func TestRunCancel(t *testing.T) {
+	in := newTestSim()
+	in.WellTime = time.Second
+	c := bmg.New(in.Conn(), bmg.StopOnCancel())
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	fl := testFl
+	start := time.Now()
+	_, err := c.RunFl(ctx, bmg.RunCfg{Plate: testPlate}, fl)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Fatal("cancelled run did not return promptly")
+	}
+	if slices.Contains(in.Flags(), bmg.FlagRunning) {
+		t.Fatal("instrument not stopped after cancel")
+	}
+}
+
+// without StopOnCancel a cancelled run is left to the instrument
+func TestRunCancelNoStop(t *testing.T) {
+	in := newTestSim()
+	in.WellTime = time.Second
+	c := bmg.New(in.Conn())
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	fl := testFl
+	_, err := c.RunFl(ctx, bmg.RunCfg{Plate: testPlate}, fl)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+	if !slices.Contains(in.Flags(), bmg.FlagRunning) {
+		t.Fatal("instrument stopped without StopOnCancel")
+	}
+}
+
+// a run exceeding RunTimeout is stopped, the initialization ahead of it isn't limited
+func TestRunTimeout(t *testing.T) {
+	in := newTestSim()
+	in.MoveTime = 100 * time.Millisecond
+	in.WellTime = time.Second
+	c := bmg.New(in.Conn(), bmg.RunTimeout(50*time.Millisecond), bmg.PollInterval(5*time.Millisecond), bmg.StopOnCancel())
+	defer c.Close()
+
+	fl := testFl
+	_, err := c.RunFl(context.Background(), bmg.RunCfg{Plate: testPlate}, fl)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+	if slices.Contains(in.Flags(), bmg.FlagRunning) {
+		t.Fatal("instrument not stopped after run timeout")
+	}
+}
+
+// status queries interleave with a run while tray motion is refused
+func TestConcurrentStatus(t *testing.T) {
+	in := newTestSim()
+	in.WellTime = 5 * time.Millisecond
+	c := bmg.New(in.Conn())
+	defer c.Close()
+	ctx := context.Background()
+
+	fl := testFl
+	done := make(chan error)
+	go func() {
+		_, err := c.RunFl(ctx, bmg.RunCfg{Plate: testPlate}, fl)
+		done <- err
+	}()
+
+	running, refused, progress := false, false, false
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !running || !refused || !progress {
+				t.Fatalf("run not observed (running %v, tray refused %v, progress %v)", running, refused, progress)
+			}
+			return
+		default:
+		}
+		s, err := c.GetStatus(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if slices.Contains(s.Flags, bmg.FlagRunning) {
+			running = true
+			if s.Total == 96 && s.Complete > 0 && s.Complete < 96 {
+				progress = true
+			}
+			if err := c.OpenTray(ctx); errors.Is(err, bmg.ErrOperationInProgress) {
+				refused = true
+			}
+		}
+	}
+}
+
+func TestRunRejected(t *testing.T) {
+	fl := testFl
+	for _, tc := range []struct {
+		name  string
+		setup func(*Instrument)
+		err   error
+	}{
+		{"lid open", func(in *Instrument) { in.SetLid(true) }, bmg.ErrLidOpen},
+		{"no plate", func(in *Instrument) { in.SetPlate(false) }, bmg.ErrNoPlate},
+	} {
+		in := newTestSim()
+		tc.setup(in)
+		c := bmg.New(in.Conn(), bmg.Experimental())
+		_, err := c.RunFl(context.Background(), bmg.RunCfg{Plate: testPlate}, fl)
+		var ie *bmg.InstrumentError
+		if !errors.Is(err, tc.err) || !errors.Is(err, bmg.ErrRejected) || !errors.As(err, &ie) {
+			t.Errorf("%s: unexpected error %v", tc.name, err)
+		}
+		c.Close()
+	}
+
+	// the instrument itself rejects malformed run commands
+	in := newTestSim()
+	in.handle([]byte{0x04, 0x00})
+	if s := in.status(); s[5] != errInvalidParameter {
+		t.Fatalf("malformed run not rejected, status % x", s)
+	}
+}
+
+func TestAbort(t *testing.T) {
+	in := newTestSim()
+	in.WellTime = 10 * time.Millisecond
+	c := bmg.New(in.Conn(), bmg.Experimental())
+	defer c.Close()
+	ctx := context.Background()
+
+	gated := bmg.New(in.Conn())
+	_, err := gated.Abort(ctx)
+	gated.Close()
+	if !errors.Is(err, bmg.ErrExperimental) {
+		t.Fatalf("abort sent without the Experimental option: %v", err)
+	}
+
+	type result struct {
+		d   bmg.FlData
+		err error
+	}
+	done := make(chan result)
+	fl := testFl
+	go func() {
+		d, err := c.RunFl(ctx, bmg.RunCfg{Plate: testPlate}, fl)
+		done <- result{d, err}
+	}()
+
+	for {
+		s, err := c.GetStatus(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.Complete > 8 && slices.Contains(s.Flags, bmg.FlagRunning) {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	partial, err := c.Abort(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !partial {
+		t.Fatal("expected partial data after abort")
+	}
+	r := <-done
+	if !errors.Is(r.err, bmg.ErrAborted) {
+		t.Fatalf("expected aborted run, got %v", r.err)
+	}
+	if r.d.Complete == 0 || r.d.Complete >= 96 || len(r.d.Vals) != r.d.Complete {
+		t.Fatalf("unexpected partial data: %d of %d values", r.d.Complete, r.d.Total)
+	}
+	if slices.Contains(in.Flags(), bmg.FlagBusy) {
+		t.Fatal("instrument still busy after abort")
+	}
+}
+
+func TestRunAbsDiscrete(t *testing.T) {
+	in := newTestSim()
+	c := bmg.New(in.Conn())
+	defer c.Close()
+	ctx := context.Background()
+
+	pl := testPlate
+	pl.SetWells(0, 1, 2, 3, 4, 5, 6, 7)
+	abs := bmg.DiscreteAbs{Wavelengths: []int{260, 280, 340}, Flashes: 22}
+	d, err := c.RunAbsDiscrete(ctx, bmg.RunCfg{Plate: pl}, abs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Wells != 8 || d.Wavelengths != 3 {
+		t.Fatalf("unexpected data shape: %d wells, %d wavelengths", d.Wells, d.Wavelengths)
+	}
+	for _, w := range d.Transmission {
+		for _, v := range w {
+			if v < 50 || v > 75 {
+				t.Fatalf("transmission out of range: %f", v)
+			}
+		}
+	}
+}
+
+func TestIdentify(t *testing.T) {
+	in := newTestSim()
+	in.Modules = []bmg.Module{bmg.ModuleFluorescence}
+	c := bmg.New(in.Conn(), bmg.Experimental())
+	defer c.Close()
+	ctx := context.Background()
+
+	gated := bmg.New(in.Conn())
+	_, err := gated.Identify(ctx)
+	gated.Close()
+	if !errors.Is(err, bmg.ErrExperimental) {
+		t.Fatalf("identification sent without the Experimental option: %v", err)
+	}
+
+	pl := testPlate
+	pl.SetWells(0)
+	abs := bmg.DiscreteAbs{Wavelengths: []int{260}, Flashes: 22}
+	id, err := c.Identify(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.Serial != in.Serial || id.Firmware != "1.35" || !slices.Equal(id.Modules, in.Modules) {
+		t.Fatalf("unexpected identity %+v", id)
+	}
+	// the identity doesn't refuse runs, the instrument does
+	if _, err := c.RunAbsDiscrete(ctx, bmg.RunCfg{Plate: pl}, abs); !errors.Is(err, bmg.ErrInvalidParameter) {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	fl := testFl
+	d, err := c.RunFl(ctx, bmg.RunCfg{Plate: pl}, fl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Instrument == nil || d.Instrument.Serial != in.Serial {
+		t.Fatalf("data not tagged with identity %+v", d.Instrument)
+	}
+}
+
+func TestRunFlFilters(t *testing.T) {
+	pl := testPlate
+	pl.SetWells(0, 1)
+	fl := testFl
+	fl.Chromats = []bmg.FlChromat{{Ex: 485, ExBw: 20, Dich: 5040, Em: 520, EmBw: 25, Gain: 1500, ExFilter: true, EmFilter: true}}
+	ctx := context.Background()
+
+	// the filter encoding is unconfirmed, it isn't sent unless asked for
+	c := bmg.New(newTestSim().Conn())
+	if _, err := c.RunFl(ctx, bmg.RunCfg{Plate: pl}, fl); !errors.Is(err, bmg.ErrExperimental) {
+		t.Fatalf("expected experimental error, got %v", err)
+	}
+	c.Close()
+
+	for _, filters := range []bool{false, true} {
+		in := newTestSim()
+		if filters {
+			in.Modules = append(in.Modules, bmg.ModuleFilters)
+		}
+		c := bmg.New(in.Conn(), bmg.Experimental())
+		if _, err := c.Identify(ctx); err != nil {
+			t.Fatal(err)
+		}
+		d, err := c.RunFl(ctx, bmg.RunCfg{Plate: pl}, fl)
+		c.Close()
+		switch {
+		case !filters && !errors.Is(err, bmg.ErrInvalidParameter):
+			t.Fatalf("unexpected error without filters %v", err)
+		case filters && err != nil:
+			t.Fatal(err)
+		case filters && (len(d.Vals) != 2 || len(d.Vals[0]) != 1):
+			t.Fatalf("unexpected values %v", d.Vals)
+		}
+	}
+}
+
+func TestRunTRF(t *testing.T) {
+	in := newTestSim()
+	in.Modules = append(in.Modules, bmg.ModuleTRF)
+	c := bmg.New(in.Conn(), bmg.Experimental())
+	defer c.Close()
+
+	pl := testPlate
+	pl.SetWells(0, 1, 2)
+	fl := testFl
+	fl.TRF = &bmg.TRFCfg{IntegrationStart: 60, IntegrationTime: 400}
+	d, err := c.RunFl(context.Background(), bmg.RunCfg{Plate: pl}, fl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.Vals) != 3 || len(d.Vals[0]) != 1 {
+		t.Fatalf("unexpected values %v", d.Vals)
+	}
+}
+
+func TestRunTRFRET(t *testing.T) {
+	in := newTestSim()
+	in.Modules = append(in.Modules, bmg.ModuleTRF, bmg.ModuleFilters)
+	c := bmg.New(in.Conn(), bmg.Experimental())
+	defer c.Close()
+
+	pl := testPlate
+	pl.SetWells(0, 1, 2, 3)
+	cfg := bmg.TRFRETCfg{
+		Donor:       bmg.FlChromat{Ex: 337, ExBw: 30, Dich: 4000, Em: 620, EmBw: 10, Gain: 2000, ExFilter: true, EmFilter: true},
+		Acceptor:    bmg.FlChromat{Ex: 337, ExBw: 30, Dich: 4000, Em: 665, EmBw: 10, Gain: 2000, ExFilter: true, EmFilter: true},
+		FocalHeight: 40,
+		Flashes:     50,
+		TRF:         bmg.TRFCfg{IntegrationStart: 60, IntegrationTime: 400},
+		Controls:    []int{2, 3},
+	}
+	nc := bmg.New(newTestSim().Conn())
+	if _, err := nc.RunTRFRET(context.Background(), bmg.RunCfg{Plate: pl}, cfg); !errors.Is(err, bmg.ErrExperimental) {
+		t.Fatalf("expected experimental error, got %v", err)
+	}
+	nc.Close()
+
+	d, err := c.RunTRFRET(context.Background(), bmg.RunCfg{Plate: pl}, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.Vals) != 4 || len(d.Ratio) != 4 || len(d.DeltaF) != 4 {
+		t.Fatalf("unexpected data shape %+v", d)
+	}
+	for i, v := range d.Vals {
+		if len(v) != 2 || d.Ratio[i] != float64(v[1])/float64(v[0]) {
+			t.Fatalf("well %d: ratio %f of %v", i, d.Ratio[i], v)
+		}
+	}
+	if math.Abs(d.DeltaF[2]+d.DeltaF[3]) > 1e-9 {
+		t.Fatalf("controls not centered on zero ΔF: %v", d.DeltaF)
+	}
+}
+
+func TestRunFlScan(t *testing.T) {
+	in := newTestSim()
+	in.WellTime = 0
+	c := bmg.New(in.Conn(), bmg.Experimental())
+	defer c.Close()
+
+	pl := testPlate
+	pl.SetWells(0, 1, 2, 3)
+	s := bmg.FlScan{Scan: bmg.ScanEx, Start: 400, Stop: 500, Step: 2, ExBw: 10, Dich: 5150, Em: 530, EmBw: 20, Gain: 1500, FocalHeight: 40, Flashes: 10}
+	d, err := c.RunFlScan(context.Background(), bmg.RunCfg{Plate: pl}, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Wells != 4 || len(d.Wavelengths) != 51 || len(d.Vals) != 4 || d.Complete != 4*51 {
+		t.Fatalf("unexpected spectrum shape: %d wells, %d points", d.Wells, len(d.Wavelengths))
+	}
+	for _, v := range d.Vals {
+		if len(v) != 51 {
+			t.Fatalf("incomplete spectrum of %d points", len(v))
+		}
+	}
+}
+
+// a 384 well, 8 wavelength read is read at once, data split across blocks isn't
+// requested on a guess
+// the largest discrete absorbance result is returned in one block
+func TestLargeData(t *testing.T) {
+	pl := bmg.PlateCfg{
+		Length:      12776,
+		Width:       8548,
+		CornerX:     1238,
+		CornerY:     899,
+		Cols:        24,
+		Rows:        16,
+		StartCorner: bmg.TopLeft,
+	}
+	for i := range pl.Wells {
+		pl.Wells[i] = 0xff
+	}
+	abs := bmg.DiscreteAbs{Wavelengths: []int{230, 260, 280, 340, 405, 450, 600, 900}, Flashes: 5}
+
+	in := newTestSim()
+	in.WellTime = 0
+	c := bmg.New(in.Conn())
+	defer c.Close()
+	d, err := c.RunAbsDiscrete(context.Background(), bmg.RunCfg{Plate: pl}, abs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Wells != 384 || d.Wavelengths != 8 || len(d.Transmission) != 384 || len(d.Transmission[383]) != 8 {
+		t.Fatalf("unexpected data shape: %d wells, %d wavelengths", d.Wells, d.Wavelengths)
+	}
+}
+
+// a run logs its commands, status transitions and phases
+func TestLogging(t *testing.T) {
+	in := newTestSim()
+	var buf bytes.Buffer
+	l := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	c := bmg.New(in.Conn(), bmg.Logger(l))
+	defer c.Close()
+
+	fl := testFl
+	if _, err := c.RunFl(context.Background(), bmg.RunCfg{Plate: testPlate}, fl); err != nil {
+		t.Fatal(err)
+	}
+
+	var tx, status, finished bool
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var rec struct {
+			Msg    string
+			Cmd    string
+			Data   string
+			Raised []bmg.FlagID
+		}
+		if err := dec.Decode(&rec); err != nil {
+			t.Fatal(err)
+		}
+		switch rec.Msg {
+		case "tx":
+			tx = tx || rec.Cmd == "run" && strings.HasPrefix(rec.Data, "04")
+		case "status":
+			status = status || slices.Contains(rec.Raised, bmg.FlagRunning)
+		case "finished":
+			finished = true
+		}
+	}
+	if !tx || !status || !finished {
+		t.Fatalf("missing log records: run command %v, running status %v, finished %v", tx, status, finished)
+	}
+}
+
+// a recorded run replays to the same result without the simulator
+func TestRecordReplayRun(t *testing.T) {
+	in := newTestSim()
+	c := bmg.New(in.Conn())
+	var rec bytes.Buffer
+	c.Record(bmg.NewRecorder(&rec))
+	ctx := context.Background()
+
+	fl := testFl
+	rc := bmg.RunCfg{Plate: testPlate}
+	want, err := c.RunFl(ctx, rc, fl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	recs, err := bmg.ReadRecording(&rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c = bmg.New(bmg.NewReplay(recs))
+	defer c.Close()
+	got, err := c.RunFl(ctx, rc, fl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatal("replayed run differs from recording")
+	}
+}
+
+func TestPty(t *testing.T) {
+	in := newTestSim()
+	p, err := in.Pty()
+	if err != nil {
+		t.Skipf("no pty available: %s", err)
+	}
+	defer p.Close()
+
+	c, err := bmg.Open(p.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ctx := context.Background()
+	if _, err := c.GetStatus(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// a second open of the tty reports this process as the holder
+func TestPtyBusy(t *testing.T) {
+	in := newTestSim()
+	p, err := in.Pty()
+	if err != nil {
+		t.Skipf("no pty available: %s", err)
+	}
+	defer p.Close()
+
+	c, err := bmg.Open(p.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = bmg.Open(p.Path)
+	var be *bmg.BusyError
+	if !errors.Is(err, bmg.ErrInstrumentBusy) || !errors.As(err, &be) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if be.Holder == nil || be.Holder.PID != os.Getpid() {
+		t.Fatalf("unexpected holder %+v", be.Holder)
+	}
+
+	// free once closed
+	c.Close()
+	c, err = bmg.Open(p.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+}
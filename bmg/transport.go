@@ -0,0 +1,58 @@
+package bmg
+
+import (
+	"fmt"
+	"io"
+	"net"
+)
+
+// Transport is the byte stream the framed serial protocol is spoken over.
+//
+// On the instrument this is the ftdi serial port (see OpenSerial), but any reliable,
+// ordered byte stream works: a TCP connection to a serial bridge, a pseudo-terminal
+// backed by a simulator, or one end of a net.Pipe in tests. Any io.ReadWriteCloser
+// can be handed directly to New.
+type Transport interface {
+	io.ReadWriteCloser
+}
+
+// serialCfg holds the termios2 parameters applied to the tty
+type serialCfg struct {
+	baud int
+}
+
+// defaults used by the CLARIOstar
+func defaultSerialCfg() serialCfg {
+	return serialCfg{baud: 125000}
+}
+
+// OpenSerial opens and configures the tty at path for the plate reader
+//
+// If using the provided udev rules the tty will be /dev/clario on linux. The tty is held
+// exclusively until closed, while another process holds it a *BusyError matching
+// ErrInstrumentBusy is returned.
+//
+// The SerialBaud option applies.
+func OpenSerial(tty string, opts ...Option) (Transport, error) {
+	cfg := collect(opts).serial
+	if cfg.baud <= 0 {
+		return nil, fmt.Errorf("invalid baud rate %d", cfg.baud)
+	}
+	f, err := openPort(tty, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// DialTCP connects to a plate reader exposed over TCP (e.g. by a Bridge)
+//
+// CmdTimeout also bounds connecting.
+func DialTCP(addr string, opts ...Option) (Transport, error) {
+	d := net.Dialer{Timeout: collect(opts).cmdTimeout, KeepAlive: bridgeKeepAlive}
+	conn, err := d.Dial("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("error dialing %s: %w", addr, err)
+	}
+	return conn, nil
+}
@@ -0,0 +1,49 @@
+package bmg
+
+import (
+	"context"
+	"io"
+	"net"
+	"slices"
+	"testing"
+)
+
+// status response captured from the instrument after initialization
+var statusResp = []byte{0x02, 0x00, 0x18, 0x0c, 0x01, 0x25, 0x00, 0x27, 0x00, 0x00, 0x03, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0xc0, 0x00, 0x01, 0x36, 0x0d}
+
+func TestDialTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, len(frame(cmdStatus)))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return
+		}
+		conn.Write(statusResp)
+	}()
+
+	tr, err := DialTCP(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := New(tr)
+	defer c.Close()
+
+	s, err := c.GetStatus(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Contains(s.Flags, FlagBusy) || !slices.Contains(s.Flags, FlagInitialized) {
+		t.Fatalf("unexpected flags %v", s.Flags)
+	}
+}
@@ -0,0 +1,53 @@
+package bmg
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// optic byte bit set for time resolved reads
+//
+// b2 is unused in every capture so far, that it flags TRF is a guess.
+const opticTRF = 1 << 2
+
+// TRFCfg makes a fluorescence read time resolved, integrating the emission over a
+// window opened after each flash so the short lived background has decayed, e.g. for
+// lanthanide (europium, terbium) labels
+//
+// the number of flashes integrated is FlCfg.Flashes. The response is assumed to share
+// the endpoint schema, values are returned in FlData as for a prompt read.
+//
+// Experimental: needs the Experimental option, see opticTRF and trfBytes.
+type TRFCfg struct {
+	IntegrationStart int `json:"integration_start"` // delay from the flash to opening the window (µs)
+	IntegrationTime  int `json:"integration_time"`  // length of the window (µs)
+}
+
+// largest integration start and time, the flash lamp runs at up to ~100Hz so anything
+// beyond a few ms is implausible
+const maxIntegration = 10000
+
+// check validates the integration window
+func (trf TRFCfg) check() error {
+	switch {
+	case trf.IntegrationStart < 0 || trf.IntegrationStart > maxIntegration:
+		return fmt.Errorf("integration start must be 0-%dµs", maxIntegration)
+	case trf.IntegrationTime <= 0 || trf.IntegrationTime > maxIntegration:
+		return fmt.Errorf("integration time must be 1-%dµs", maxIntegration)
+	}
+	return nil
+}
+
+// trfBytes serializes the integration window into the first four of the trailing bytes
+// preceding the flashes, zero for a prompt read
+//
+// those bytes are zero in every endpoint capture, where the window really goes and its
+// units are unknown.
+func trfBytes(trf *TRFCfg) []byte {
+	b := make([]byte, 0, 4)
+	if trf == nil {
+		return append(b, 0x00, 0x00, 0x00, 0x00)
+	}
+	b = binary.BigEndian.AppendUint16(b, uint16(trf.IntegrationStart))
+	return binary.BigEndian.AppendUint16(b, uint16(trf.IntegrationTime))
+}
@@ -0,0 +1,59 @@
+package bmg
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTRF(t *testing.T) {
+	pl := PlateCfg{
+		Length:      12776,
+		Width:       8548,
+		CornerX:     1438,
+		CornerY:     1124,
+		Cols:        12,
+		Rows:        8,
+		StartCorner: TopLeft,
+	}
+	rc := RunCfg{Plate: pl}
+	fl := FlCfg{
+		Chromats:    []FlChromat{{Ex: 337, ExBw: 30, Dich: 4000, Em: 620, EmBw: 10, Gain: 2000, ExFilter: true, EmFilter: true}},
+		FocalHeight: 40,
+		Flashes:     50,
+		TRF:         &TRFCfg{IntegrationStart: 60, IntegrationTime: 400},
+	}
+
+	cmd, err := flBytes(rc, fl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prompt := fl
+	prompt.TRF = nil
+	pcmd, err := flBytes(rc, prompt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cmd) != len(pcmd) || cmd[64]&opticTRF == 0 || pcmd[64]&opticTRF != 0 {
+		t.Fatal("time resolved read not flagged in optic byte")
+	}
+
+	r, err := DecodeRun(frame(cmd))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Fl == nil || !reflect.DeepEqual(*r.Fl, fl) || len(r.Unknown) != 0 {
+		t.Fatalf("decoded run differs: %+v %+v", r.Fl, r.Unknown)
+	}
+
+	for _, bad := range []TRFCfg{{IntegrationStart: -1, IntegrationTime: 400}, {IntegrationStart: 60}, {IntegrationStart: 60, IntegrationTime: 20000}} {
+		fl.TRF = &bad
+		if _, err := flBytes(rc, fl); err == nil {
+			t.Fatalf("invalid window accepted %+v", bad)
+		}
+	}
+	fl.TRF = &TRFCfg{IntegrationStart: 60, IntegrationTime: 400}
+	fl.Flashes = 0
+	if _, err := flBytes(rc, fl); err == nil {
+		t.Fatal("time resolved read without flashes accepted")
+	}
+}
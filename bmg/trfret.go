@@ -0,0 +1,121 @@
+package bmg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// optic byte bit set when the two chromats are read simultaneously on both detectors
+//
+// b3 is unused in every capture so far, that it selects dual emission is a guess and
+// the chromats may need a marker of their own.
+const opticDualEm = 1 << 3
+
+// TRFRETCfg configures a TR-FRET (e.g. HTRF) read, the donor and acceptor emissions
+// are measured simultaneously from a shared, time resolved excitation
+//
+// Experimental: needs the Experimental option, see opticDualEm and TRFCfg.
+type TRFRETCfg struct {
+	Donor    FlChromat `json:"donor"`    // e.g. ex 337 em 620
+	Acceptor FlChromat `json:"acceptor"` // e.g. ex 337 em 665, optics other than the emission must match the donor
+
+	FocalHeight  int    `json:"focal_height"`  // focal height (mm) * 100
+	Flashes      int    `json:"flashes"`       // number of flashes 1-200
+	BottomOptic  bool   `json:"bottom_optic"`  // use bottom optic, defaults to top optic
+	SettlingTime int    `json:"settling_time"` // 0-10 deciseconds
+	TRF          TRFCfg `json:"trf"`           // integration window
+	Controls     []int  `json:"controls"`      // negative control wells for ΔF, indexed as in SetWells
+}
+
+// TRFRETData holds both channels of a TR-FRET read with the ratios computed from them
+type TRFRETData struct {
+	FlData           // raw values, [well][donor, acceptor]
+	Ratio  []float64 `json:"ratio"`             // acceptor/donor per well, 0 where either wasn't read
+	DeltaF []float64 `json:"delta_f,omitempty"` // ΔF% per well against the mean ratio of the controls
+}
+
+// RunTRFRET runs a TR-FRET read, blocking until the data is read or ctx is done
+//
+// HTRF results are often reported as the ratio * 10^4, ΔF% is the same either way. If
+// the run is stopped by Abort the ratios of the wells measured so far are returned
+// with ErrAborted.
+//
+// Experimental: fails with ErrExperimental unless the Experimental option is set.
+func (c *Clario) RunTRFRET(ctx context.Context, rc RunCfg, cfg TRFRETCfg) (TRFRETData, error) {
+	fl := cfg.flCfg()
+	if _, err := flBytes(rc, fl); err != nil {
+		return TRFRETData{}, err
+	}
+	ctl, err := controlIdx(rc.Plate, cfg.Controls)
+	if err != nil {
+		return TRFRETData{}, err
+	}
+	d, err := c.RunFl(ctx, rc, fl)
+	if err != nil && !errors.Is(err, ErrAborted) {
+		return TRFRETData{}, err
+	}
+	return ratios(d, ctl), err
+}
+
+// flCfg returns the fluorescence configuration measuring both channels
+func (cfg TRFRETCfg) flCfg() FlCfg {
+	trf := cfg.TRF
+	return FlCfg{
+		Chromats:     []FlChromat{cfg.Donor, cfg.Acceptor},
+		FocalHeight:  cfg.FocalHeight,
+		Flashes:      cfg.Flashes,
+		BottomOptic:  cfg.BottomOptic,
+		SettlingTime: cfg.SettlingTime,
+		TRF:          &trf,
+		DualEm:       true,
+	}
+}
+
+// controlIdx maps the control wells to their index in the measured wells
+func controlIdx(pl PlateCfg, controls []int) ([]int, error) {
+	pos := map[int]int{}
+	for i, w := range pl.selected() {
+		pos[w] = i
+	}
+	idx := make([]int, 0, len(controls))
+	for _, w := range controls {
+		i, ok := pos[w]
+		if !ok {
+			return nil, fmt.Errorf("control well %d is not measured", w)
+		}
+		idx = append(idx, i)
+	}
+	return idx, nil
+}
+
+// ratios computes the acceptor/donor ratio of each well and, given controls, the ΔF%
+func ratios(d FlData, controls []int) TRFRETData {
+	r := TRFRETData{FlData: d, Ratio: make([]float64, len(d.Vals))}
+	for i, v := range d.Vals {
+		if len(v) == 2 && v[0] != 0 {
+			r.Ratio[i] = float64(v[1]) / float64(v[0])
+		}
+	}
+
+	// wells a partial read didn't reach are left out of the negative
+	var neg float64
+	var n int
+	for _, i := range controls {
+		if i < len(r.Ratio) && r.Ratio[i] != 0 {
+			neg += r.Ratio[i]
+			n++
+		}
+	}
+	if n == 0 {
+		return r
+	}
+	neg /= float64(n)
+	r.DeltaF = make([]float64, len(r.Ratio))
+	for i, v := range r.Ratio {
+		if v != 0 {
+			r.DeltaF[i] = (v - neg) / neg * 100
+		}
+	}
+	return r
+}
@@ -0,0 +1,91 @@
+package bmg
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestTRFRET(t *testing.T) {
+	pl := PlateCfg{
+		Length:      12776,
+		Width:       8548,
+		CornerX:     1438,
+		CornerY:     1124,
+		Cols:        12,
+		Rows:        8,
+		StartCorner: TopLeft,
+	}
+	pl.SetWells(0, 1, 12, 13)
+	rc := RunCfg{Plate: pl}
+	cfg := TRFRETCfg{
+		Donor:       FlChromat{Ex: 337, ExBw: 30, Dich: 4000, Em: 620, EmBw: 10, Gain: 2000, ExFilter: true, EmFilter: true},
+		Acceptor:    FlChromat{Ex: 337, ExBw: 30, Dich: 4000, Em: 665, EmBw: 10, Gain: 2000, ExFilter: true, EmFilter: true},
+		FocalHeight: 40,
+		Flashes:     50,
+		TRF:         TRFCfg{IntegrationStart: 60, IntegrationTime: 400},
+		Controls:    []int{12, 13},
+	}
+
+	fl := cfg.flCfg()
+	cmd, err := flBytes(rc, fl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := DecodeRun(frame(cmd))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Fl == nil || !reflect.DeepEqual(*r.Fl, fl) || len(r.Unknown) != 0 {
+		t.Fatalf("decoded run differs: %+v %+v", r.Fl, r.Unknown)
+	}
+
+	bad := cfg
+	bad.Acceptor.Ex = 340
+	if _, err := flBytes(rc, bad.flCfg()); err == nil {
+		t.Fatal("dual emission with differing excitation accepted")
+	}
+
+	if _, err := controlIdx(pl, []int{2}); err == nil {
+		t.Fatal("unmeasured control accepted")
+	}
+	ctl, err := controlIdx(pl, cfg.Controls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ctl, []int{2, 3}) {
+		t.Fatalf("unexpected control index %v", ctl)
+	}
+
+	// controls on a 384 well plate index as SetWells does
+	pl384 := PlateCfg{Rows: 16, Cols: 24}
+	pl384.SetWells(0, 20, 100, 383)
+	ctl384, err := controlIdx(pl384, []int{20, 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ctl384, []int{1, 2}) {
+		t.Fatalf("unexpected 384 well control index %v", ctl384)
+	}
+	if _, err := controlIdx(pl384, []int{12}); err == nil {
+		t.Fatal("unmeasured 384 well control accepted")
+	}
+
+	d := ratios(FlData{Vals: [][]uint32{{1000, 500}, {1000, 300}, {1000, 100}, {1000, 100}}}, ctl)
+	for i, want := range []float64{0.5, 0.3, 0.1, 0.1} {
+		if math.Abs(d.Ratio[i]-want) > 1e-9 {
+			t.Fatalf("ratio %d: got %f, want %f", i, d.Ratio[i], want)
+		}
+	}
+	for i, want := range []float64{400, 200, 0, 0} {
+		if math.Abs(d.DeltaF[i]-want) > 1e-9 {
+			t.Fatalf("ΔF %d: got %f, want %f", i, d.DeltaF[i], want)
+		}
+	}
+
+	// partial read stopping before the controls
+	d = ratios(FlData{Vals: [][]uint32{{1000, 500}, {1000}}}, ctl)
+	if d.Ratio[1] != 0 || d.DeltaF != nil {
+		t.Fatalf("unexpected partial ratios %+v", d)
+	}
+}
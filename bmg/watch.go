@@ -0,0 +1,134 @@
+package bmg
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"time"
+)
+
+// EventType identifies a status change reported by Watch
+type EventType string
+
+const (
+	EventFlagRaised    EventType = "FLAG_RAISED"    // Event.Flag was raised
+	EventFlagCleared   EventType = "FLAG_CLEARED"   // Event.Flag was cleared
+	EventTrayOpened    EventType = "TRAY_OPENED"    // tray sled reached the open position
+	EventTrayClosed    EventType = "TRAY_CLOSED"    // tray sled left the open position
+	EventPlateDetected EventType = "PLATE_DETECTED" // a plate was detected on the carrier
+	EventPlateRemoved  EventType = "PLATE_REMOVED"  // the plate is no longer detected
+	EventRunStarted    EventType = "RUN_STARTED"    // a measurement started
+	EventRunFinished   EventType = "RUN_FINISHED"   // the measurement finished or was stopped
+	EventDataAvailable EventType = "DATA_AVAILABLE" // unread data is waiting on the instrument
+	EventProgress      EventType = "PROGRESS"       // measured value count changed during a run
+	EventError         EventType = "ERROR"          // polling failed, see Event.Err
+)
+
+// Event is a change in instrument status
+type Event struct {
+	Time   time.Time `json:"time"`
+	Type   EventType `json:"type"`
+	Flag   FlagID    `json:"flag,omitempty"` // for flag raised/cleared events
+	Status Status    `json:"status"`         // status the change was observed in
+	Err    error     `json:"-"`              // for error events
+}
+
+// events raised in addition to EventFlagRaised/EventFlagCleared for specific flags
+var flagEvents = map[FlagID][2]EventType{
+	FlagOpen:          {EventTrayOpened, EventTrayClosed},
+	FlagPlateDetected: {EventPlateDetected, EventPlateRemoved},
+	FlagRunning:       {EventRunStarted, EventRunFinished},
+	FlagUnreadData:    {EventDataAvailable, ""},
+}
+
+// Watch polls the instrument status every interval (PollInterval if 0) and delivers
+// only the changes as events, until ctx is done or the connection is closed. The first
+// poll reports the flags already raised.
+//
+// Polls interleave with any other commands in flight. Events are delivered in order,
+// a slow receiver delays the next poll rather than dropping events.
+func (c *Clario) Watch(ctx context.Context, interval time.Duration) <-chan Event {
+	if interval <= 0 {
+		interval = c.poll
+	}
+	ch := make(chan Event)
+
+	go func() {
+		defer close(ch)
+		send := func(e Event) bool {
+			select {
+			case ch <- e:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		var last *Status
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			resp, err := c.write(ctx, cmdStatus)
+			var s Status
+			if err == nil {
+				s, err = parseStatus(resp)
+			}
+			now := time.Now()
+			switch {
+			case ctx.Err() != nil:
+				return
+			case err != nil:
+				if !send(Event{Time: now, Type: EventError, Err: err}) || errors.Is(err, ErrClosed) {
+					return
+				}
+			default:
+				for _, e := range statusEvents(last, s) {
+					e.Time = now
+					if !send(e) {
+						return
+					}
+				}
+				last = &s
+			}
+
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+// statusEvents returns the events describing the change from last to s, last is nil
+// on the first poll
+func statusEvents(last *Status, s Status) []Event {
+	var prev []FlagID
+	if last != nil {
+		if slices.Equal(last.Raw, s.Raw) {
+			return nil
+		}
+		prev = last.Flags
+	}
+
+	var evs []Event
+	for _, f := range statusFlags {
+		was, is := slices.Contains(prev, f.ID), slices.Contains(s.Flags, f.ID)
+		if was == is {
+			continue
+		}
+		typ, idx := EventFlagRaised, 0
+		if was {
+			typ, idx = EventFlagCleared, 1
+		}
+		evs = append(evs, Event{Type: typ, Flag: f.ID, Status: s})
+		if derived := flagEvents[f.ID][idx]; derived != "" {
+			evs = append(evs, Event{Type: derived, Flag: f.ID, Status: s})
+		}
+	}
+	if last != nil && s.Complete != last.Complete && slices.Contains(s.Flags, FlagRunning) {
+		evs = append(evs, Event{Type: EventProgress, Status: s})
+	}
+	return evs
+}
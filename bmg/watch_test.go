@@ -0,0 +1,57 @@
+package bmg
+
+import (
+	"slices"
+	"testing"
+)
+
+func statusOf(t *testing.T, resp ...byte) Status {
+	t.Helper()
+	s, err := parseStatus(append(resp, make([]byte, 17-len(resp))...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func eventTypes(evs []Event) []EventType {
+	var types []EventType
+	for _, e := range evs {
+		types = append(types, e.Type)
+	}
+	return types
+}
+
+func TestStatusEvents(t *testing.T) {
+	idle := statusOf(t, 0x01, 0x01, 0x00, 0x22)    // initialized, plate detected
+	running := statusOf(t, 0x01, 0x31, 0x00, 0x22) // busy, running
+	done := statusOf(t, 0x01, 0x01, 0x01, 0x22)    // unread data
+
+	got := eventTypes(statusEvents(nil, idle))
+	want := []EventType{EventFlagRaised, EventFlagRaised, EventFlagRaised, EventPlateDetected}
+	if !slices.Equal(got, want) {
+		t.Fatalf("first poll: got %v", got)
+	}
+
+	if evs := statusEvents(&idle, idle); len(evs) != 0 {
+		t.Fatalf("unchanged status produced events %v", eventTypes(evs))
+	}
+
+	got = eventTypes(statusEvents(&idle, running))
+	want = []EventType{EventFlagRaised, EventFlagRaised, EventRunStarted}
+	if !slices.Equal(got, want) {
+		t.Fatalf("run start: got %v", got)
+	}
+
+	got = eventTypes(statusEvents(&running, done))
+	want = []EventType{EventFlagCleared, EventFlagCleared, EventRunFinished, EventFlagRaised, EventDataAvailable}
+	if !slices.Equal(got, want) {
+		t.Fatalf("run finish: got %v", got)
+	}
+
+	progress := statusOf(t, 0x01, 0x31, 0x00, 0x22, 0x00, 0x00, 0x21, 0x00, 0x60, 0x00, 0x08)
+	got = eventTypes(statusEvents(&running, progress))
+	if !slices.Equal(got, []EventType{EventProgress}) {
+		t.Fatalf("progress: got %v", got)
+	}
+}
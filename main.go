@@ -1,49 +1,96 @@
 package main
 
 import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
+	"net"
 	"os"
+	"os/signal"
+	"strings"
+	"time"
 
 	"github.com/hoxbio/bmg-clariostar/bmg"
+	"github.com/hoxbio/bmg-clariostar/bmg/sim"
 )
 
 var usage = `
 
-Usage: bmg-clariostar verb
-
-For now the only verb is the non-verb qubit, which runs a sbs 96w pcr plate
-for the raw qubit fl values
-
+Usage: bmg-clariostar [-dev tty|tcp://host:port] verb
 
+Verbs:
+	qubit	runs a sbs 96w pcr plate for the raw qubit fl values
+	sim	serves a simulated plate reader on a pseudo-terminal, point -dev at
+		the printed path from another invocation
+	bridge	exposes -dev over TCP on -listen for a remote host to use with
+		-dev tcp://host:port or bmg.Dial, one client at a time
+	identify	prints the firmware version, serial number and installed modules,
+		requires -experimental
+	abort	sends stop for the measurement or shaking in progress and waits for
+		the instrument to be idle, requires -experimental
+	watch	prints status changes and the raw status bit fields, useful for
+		perturbing the instrument to identify flags
+	decode	decodes a run command given as hex (framed or not) in the arguments
+		or on stdin, printing the configuration as JSON
 
 `
 
 func main() {
 
-	args := os.Args
+	dev := flag.String("dev", "/dev/clario", "plate reader tty")
+	record := flag.String("record", "", "record the session's frames to this file")
+	listen := flag.String("listen", "127.0.0.1:4040", "address the bridge listens on, the bridge is unauthenticated so give a wider address explicitly")
+	level := flag.String("log", "warn", "log level written to stderr: debug, info, warn or error")
+	stopRun := flag.Bool("stop", false, "stop the instrument when a run is interrupted, the stop opcode is unconfirmed")
+	experimental := flag.Bool("experimental", false, "allow commands and modes encoded without a capture, see the README")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	args := flag.Args()
+
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(*level)); err != nil {
+		log.Fatalf("invalid log level: %s", err)
+	}
+	logger := bmg.Logger(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: lvl})))
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
 
-	if len(args) < 2 {
+	if len(args) < 1 {
 		fmt.Println("no verb provided")
-		fmt.Println(usage)
+		flag.Usage()
 		return
 	}
 
-	switch args[1] {
+	switch args[0] {
 	case "qubit":
-		c, err := bmg.Open("/dev/clario")
+		opts := []bmg.Option{logger}
+		if *stopRun {
+			opts = append(opts, bmg.StopOnCancel())
+		}
+		c, done, err := open(*dev, *record, opts...)
 		if err != nil {
 			log.Fatalf("could not open dev: %s", err)
 		}
 
 		// qubit config
 		fl := bmg.FlCfg{
-			Ex:           483,
-			ExBw:         14,
-			Dich:         5025,
-			Em:           530,
-			EmBw:         30,
-			Gain:         3000,
+			Chromats: []bmg.FlChromat{{
+				Ex:   483,
+				ExBw: 14,
+				Dich: 5025,
+				Em:   530,
+				EmBw: 30,
+				Gain: 3000,
+			}},
 			FocalHeight:  40,
 			Flashes:      200,
 			SettlingTime: 0,
@@ -59,8 +106,162 @@ func main() {
 			StartCorner: bmg.TopLeft,
 		}
 		rc := bmg.RunCfg{Plate: pl}
-		c.RunFl(rc, fl)
-		c.Close()
+		d, err := c.RunFl(ctx, rc, fl)
+		done()
+		if err != nil {
+			log.Fatalf("run failed: %s", err)
+		}
+		json.NewEncoder(os.Stdout).Encode(d)
+
+	case "sim":
+		p, err := sim.New().Pty()
+		if err != nil {
+			log.Fatalf("could not start simulator: %s", err)
+		}
+		fmt.Println(p.Path)
+
+		<-ctx.Done()
+		p.Close()
+
+	case "bridge":
+		// the bridge is long lived, ride out the adapter re-enumerating
+		t, err := bmg.ReconnectSerial(*dev, logger)
+		if err != nil {
+			log.Fatalf("could not open dev: %s", err)
+		}
+		l, err := net.Listen("tcp", *listen)
+		if err != nil {
+			log.Fatalf("could not listen: %s", err)
+		}
+		b := bmg.NewBridge(t, logger)
+		go func() {
+			<-ctx.Done()
+			b.Close()
+		}()
+		log.Printf("bridging %s on %s", *dev, l.Addr())
+		if err := b.Serve(l); err != nil && ctx.Err() == nil {
+			log.Fatalf("bridge failed: %s", err)
+		}
+
+	case "identify":
+		opts := []bmg.Option{logger}
+		if *experimental {
+			opts = append(opts, bmg.Experimental())
+		}
+		c, done, err := open(*dev, *record, opts...)
+		if err != nil {
+			log.Fatalf("could not open dev: %s", err)
+		}
+		id, err := c.Identify(ctx)
+		done()
+		if err != nil {
+			log.Fatalf("identification failed: %s", err)
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(id)
+
+	case "abort":
+		opts := []bmg.Option{logger}
+		if *experimental {
+			opts = append(opts, bmg.Experimental())
+		}
+		c, done, err := open(*dev, *record, opts...)
+		if err != nil {
+			log.Fatalf("could not open dev: %s", err)
+		}
+		partial, err := c.Abort(ctx)
+		done()
+		if err != nil {
+			log.Fatalf("abort failed: %s", err)
+		}
+		// the stop opcode is unconfirmed, an idle instrument may have finished on its own
+		fmt.Printf("stop sent, instrument idle, unread data reported: %v\n", partial)
+
+	case "watch":
+		c, done, err := open(*dev, *record, logger)
+		if err != nil {
+			log.Fatalf("could not open dev: %s", err)
+		}
+		for e := range c.Watch(ctx, 0) {
+			switch e.Type {
+			case bmg.EventError:
+				fmt.Printf("%s %s %s\n", e.Time.Format(time.TimeOnly), e.Type, e.Err)
+			case bmg.EventFlagRaised, bmg.EventFlagCleared:
+				fmt.Printf("%s %s %s\n", e.Time.Format(time.TimeOnly), e.Type, e.Flag)
+				for i, b := range e.Status.Raw[:6] {
+					fmt.Printf("%d: %08b ", i, b)
+				}
+				fmt.Println()
+			default:
+				fmt.Printf("%s %s\n", e.Time.Format(time.TimeOnly), e.Type)
+			}
+		}
+		done()
+
+	case "decode":
+		in := strings.Join(args[1:], "")
+		if in == "" {
+			b, err := io.ReadAll(os.Stdin)
+			if err != nil {
+				log.Fatalf("could not read stdin: %s", err)
+			}
+			in = string(b)
+		}
+		// tolerate the usual hex dump separators
+		in = strings.NewReplacer(" ", "", "\n", "", "\t", "", "0x", "", ",", "").Replace(in)
+		cmd, err := hex.DecodeString(in)
+		if err != nil {
+			log.Fatalf("invalid hex: %s", err)
+		}
+		r, err := bmg.DecodeRun(cmd)
+		if err != nil {
+			log.Fatalf("could not decode run: %s", err)
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(r)
+
+	default:
+		fmt.Printf("unknown verb %s\n", args[0])
+		flag.Usage()
+	}
+
+}
+
+// open connects to the plate reader, recording the session if a path is given
+//
+// a dev of the form tcp://host:port connects to a bridge. The returned func closes the
+// connection and the recording, reporting a recording that failed to be written.
+func open(dev, record string, opts ...bmg.Option) (*bmg.Clario, func(), error) {
+	var c *bmg.Clario
+	var err error
+	if addr, ok := strings.CutPrefix(dev, "tcp://"); ok {
+		c, err = bmg.Dial(addr, opts...)
+	} else {
+		c, err = bmg.Open(dev, opts...)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if record == "" {
+		return c, c.Close, nil
 	}
 
+	f, err := os.Create(record)
+	if err != nil {
+		c.Close()
+		return nil, nil, err
+	}
+	rec := bmg.NewRecorder(f)
+	c.Record(rec)
+	return c, func() {
+		c.Close()
+		if err := rec.Err(); err != nil {
+			log.Printf("recording incomplete: %s", err)
+		}
+		if err := f.Close(); err != nil {
+			log.Printf("could not close recording: %s", err)
+		}
+	}, nil
 }